@@ -0,0 +1,85 @@
+package common
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// JSONStringWriter escapes everything written to it as contents of a
+// JSON string (without the surrounding quotes) the same way json.Marshal
+// does, so large strings can be streamed instead of being marshalled
+// in memory. Invalid UTF-8 is replaced with U+FFFD. Close must be called
+// to flush an incomplete trailing UTF-8 sequence
+type JSONStringWriter struct {
+	w       io.Writer
+	pending []byte
+	out     []byte
+}
+
+// NewJSONStringWriter creates a JSONStringWriter writing to w
+func NewJSONStringWriter(w io.Writer) *JSONStringWriter {
+	return &JSONStringWriter{w: w}
+}
+
+func (jw *JSONStringWriter) Write(p []byte) (int, error) {
+	data := p
+	if len(jw.pending) > 0 {
+		data = append(jw.pending, p...)
+		jw.pending = nil
+	}
+
+	jw.out = jw.out[:0]
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			// the rest of the rune is expected in the next Write call
+			jw.pending = append(jw.pending[:0], data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		jw.appendRune(r, size)
+		data = data[size:]
+	}
+
+	_, err := jw.w.Write(jw.out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close flushes an incomplete UTF-8 sequence left from the last
+// Write call. It doesn't close the underlying writer
+func (jw *JSONStringWriter) Close() error {
+	if len(jw.pending) == 0 {
+		return nil
+	}
+	jw.out = jw.out[:0]
+	for range jw.pending {
+		jw.out = append(jw.out, `\ufffd`...)
+	}
+	jw.pending = nil
+	_, err := jw.w.Write(jw.out)
+	return err
+}
+
+func (jw *JSONStringWriter) appendRune(r rune, size int) {
+	switch {
+	case r == utf8.RuneError && size == 1:
+		jw.out = append(jw.out, `\ufffd`...)
+	case r == '"' || r == '\\':
+		jw.out = append(jw.out, '\\', byte(r))
+	case r == '\n':
+		jw.out = append(jw.out, '\\', 'n')
+	case r == '\r':
+		jw.out = append(jw.out, '\\', 'r')
+	case r == '\t':
+		jw.out = append(jw.out, '\\', 't')
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		jw.out = append(jw.out, '\\', 'u',
+			hexDigits[r>>12&0xf], hexDigits[r>>8&0xf], hexDigits[r>>4&0xf], hexDigits[r&0xf])
+	default:
+		jw.out = utf8.AppendRune(jw.out, r)
+	}
+}
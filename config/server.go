@@ -10,6 +10,11 @@ import (
 
 const (
 	defaultReplicationTimeout = 250 // ms
+	defaultAdminTimeout       = 60  // s
+	defaultDurability         = "none"
+	defaultGroupCommitWindow  = 5 // ms
+	defaultCodec              = "gzip"
+	defaultReapInterval       = 60 // s
 )
 
 // ServerCfg represents a server config
@@ -18,7 +23,19 @@ type ServerCfg struct {
 	IsMaster           bool
 	ReplicateTo        string
 	ReplicationTimeout time.Duration
+	AdminTimeout       time.Duration
 	StorageFileName    string
+	Mmap               bool
+	Segmented          bool
+	Durability         string
+	GroupCommitWindow  time.Duration
+	Codec              string
+	DictFileName       string
+	KeyFileName        string
+	KeyIndexFileName   string
+	DedupIndexFileName string
+	CacheSize          int
+	ReapInterval       time.Duration
 	LogFileName        string
 }
 
@@ -47,6 +64,78 @@ func ReadServerConfig(r io.Reader) (*ServerCfg, error) {
 		return nil, fmt.Errorf("error reading storage.file: %s", err)
 	}
 
+	cfg.Mmap, err = p.GetBool("storage.mmap")
+	if err != nil {
+		cfg.Mmap = false
+	}
+
+	cfg.Segmented, err = p.GetBool("storage.segmented")
+	if err != nil {
+		cfg.Segmented = false
+	}
+	if cfg.Segmented && cfg.Mmap {
+		return nil, fmt.Errorf("storage.mmap can't be used with segmented storages")
+	}
+
+	cfg.Durability, err = p.GetString("storage.durability")
+	if err != nil {
+		cfg.Durability = defaultDurability
+	}
+	switch cfg.Durability {
+	case "none", "always", "group":
+	default:
+		return nil, fmt.Errorf("invalid storage.durability '%s', must be one of none, always or group", cfg.Durability)
+	}
+
+	window, err := p.GetInt("storage.group_commit_window")
+	if err != nil {
+		window = defaultGroupCommitWindow
+	}
+	cfg.GroupCommitWindow = time.Duration(window) * time.Millisecond
+
+	cfg.Codec, err = p.GetString("storage.codec")
+	if err != nil {
+		cfg.Codec = defaultCodec
+	}
+
+	cacheMB, err := p.GetInt("storage.cache_mb")
+	if err != nil {
+		cacheMB = 0
+	}
+	if cacheMB < 0 {
+		return nil, fmt.Errorf("invalid storage.cache_mb %d", cacheMB)
+	}
+	cfg.CacheSize = cacheMB << 20
+
+	reapInterval, err := p.GetInt("storage.reap_interval")
+	if err != nil {
+		reapInterval = defaultReapInterval
+	}
+	if reapInterval < 0 {
+		return nil, fmt.Errorf("invalid storage.reap_interval %d", reapInterval)
+	}
+	cfg.ReapInterval = time.Duration(reapInterval) * time.Second
+
+	cfg.DictFileName, err = p.GetString("storage.dict")
+	if err != nil {
+		cfg.DictFileName = ""
+	}
+
+	cfg.KeyFileName, err = p.GetString("storage.key_file")
+	if err != nil {
+		cfg.KeyFileName = ""
+	}
+
+	cfg.KeyIndexFileName, err = p.GetString("storage.key_index")
+	if err != nil {
+		cfg.KeyIndexFileName = ""
+	}
+
+	cfg.DedupIndexFileName, err = p.GetString("storage.dedup_index")
+	if err != nil {
+		cfg.DedupIndexFileName = ""
+	}
+
 	if p.KeyExists("replica.host") {
 		cfg.ReplicateTo, err = p.GetString("replica.host")
 		if err != nil {
@@ -58,6 +147,15 @@ func ReadServerConfig(r io.Reader) (*ServerCfg, error) {
 			timeout = defaultReplicationTimeout
 		}
 		cfg.ReplicationTimeout = time.Duration(timeout) * time.Millisecond
+
+		adminTimeout, err := p.GetInt("replica.admin_timeout")
+		if err != nil {
+			adminTimeout = defaultAdminTimeout
+		}
+		if adminTimeout <= 0 {
+			return nil, fmt.Errorf("invalid replica.admin_timeout %d", adminTimeout)
+		}
+		cfg.AdminTimeout = time.Duration(adminTimeout) * time.Second
 	}
 
 	cfg.LogFileName, err = p.GetString("main.log")
@@ -20,11 +20,93 @@ func main() {
 	storageID := createCmd.Int("i", "stid",
 		&argparse.Options{Default: 0, Help: "assign storage id (default or zero forces random storage id to be used)"})
 
+	createSegCmd := parser.NewCommand("create-segmented", "creates a new segmented bs storage. segment files <base>.0000, <base>.0001 etc. are added when the storage runs out of chunks")
+	segChunkSize := createSegCmd.Int("s", "size",
+		&argparse.Options{Required: true, Help: "size of a single chunk data (not including chunk header)"})
+	segChunks := createSegCmd.Int("c", "chunks",
+		&argparse.Options{Required: true, Help: "number of chunks per segment"})
+	segBase := createSegCmd.String("f", "file",
+		&argparse.Options{Required: true, Help: "base filename of segments"})
+	segStorageID := createSegCmd.Int("i", "stid",
+		&argparse.Options{Default: 0, Help: "assign storage id (default or zero forces random storage id to be used)"})
+
 	moveCmd := parser.NewCommand("move", "moves data from one storage to another. output storage may not be empty so it's possible to combine data from different storages into one")
 	inputFile := moveCmd.File("i", "input", os.O_RDONLY, 0644,
 		&argparse.Options{Required: true, Help: "input storage file"})
 	outputFile := moveCmd.File("o", "output", os.O_RDWR, 0644,
 		&argparse.Options{Required: true, Help: "output storage file"})
+	moveWorkers := moveCmd.Int("w", "workers",
+		&argparse.Options{Default: 0, Help: "number of goroutines reading items (default or zero means the number of CPUs)"})
+	moveUnordered := moveCmd.Flag("u", "unordered",
+		&argparse.Options{Help: "write items concurrently not keeping their order"})
+	moveDict := moveCmd.String("d", "dict",
+		&argparse.Options{Help: "dictionary file of the input storage"})
+	moveKeys := moveCmd.String("k", "keys",
+		&argparse.Options{Help: "key file of the input storage"})
+	moveOutDict := moveCmd.String("D", "output-dict",
+		&argparse.Options{Help: "dictionary file of the output storage"})
+	moveOutKeys := moveCmd.String("K", "output-keys",
+		&argparse.Options{Help: "key file of the output storage"})
+
+	compactCmd := parser.NewCommand("compact", "rewrites a storage densely into a new file keeping its storage id. the old to new item id mapping is written to a tab-separated map file")
+	compactInput := compactCmd.File("i", "input", os.O_RDONLY, 0644,
+		&argparse.Options{Required: true, Help: "input storage file"})
+	compactOutput := compactCmd.File("o", "output", os.O_CREATE|os.O_RDWR|os.O_EXCL, 0644,
+		&argparse.Options{Required: true, Help: "output storage file to create"})
+	compactMap := compactCmd.File("m", "map", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644,
+		&argparse.Options{Required: true, Help: "file to write the old to new item id mapping to"})
+	compactChunkSize := compactCmd.Int("s", "size",
+		&argparse.Options{Default: 0, Help: "output chunk data size (default or zero keeps input chunk data size)"})
+	compactNumChunks := compactCmd.Int("c", "chunks",
+		&argparse.Options{Default: 0, Help: "output number of chunks (default or zero keeps input data capacity)"})
+	compactWorkers := compactCmd.Int("w", "workers",
+		&argparse.Options{Default: 0, Help: "number of goroutines reading items (default or zero means the number of CPUs)"})
+	compactDict := compactCmd.String("d", "dict",
+		&argparse.Options{Help: "dictionary file of the input storage, it's assigned to the output storage as well"})
+	compactKeys := compactCmd.String("k", "keys",
+		&argparse.Options{Help: "key file of the input storage, the output storage is encrypted with its active key"})
+
+	upgradeCmd := parser.NewCommand("upgrade", "migrates a storage file to the current format version in place. item ids are kept intact")
+	upgradeFile := upgradeCmd.String("f", "file",
+		&argparse.Options{Required: true, Help: "storage file to upgrade, base filename of segments for a segmented storage"})
+	upgradeDryRun := upgradeCmd.Flag("n", "dry-run",
+		&argparse.Options{Help: "only show upgrade steps without changing anything"})
+	upgradeBackup := upgradeCmd.Flag("b", "backup",
+		&argparse.Options{Help: "copy the storage file to <file>.v<version>.bak before upgrading"})
+	upgradeNoBackup := upgradeCmd.Flag("", "no-backup-i-know",
+		&argparse.Options{Help: "run upgrade steps which aren't restartable without a backup, an interrupted upgrade corrupts the storage then"})
+
+	trainDictCmd := parser.NewCommand("train-dict", "builds a compression dictionary from items of a storage and assigns it to the storage. small items written afterwards are compressed with the dictionary so servers must have it configured")
+	trainDictInput := trainDictCmd.File("f", "file", os.O_RDWR, 0644,
+		&argparse.Options{Required: true, Help: "storage file"})
+	trainDictOutput := trainDictCmd.File("o", "output", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644,
+		&argparse.Options{Required: true, Help: "dictionary file to create"})
+	trainDictSize := trainDictCmd.Int("s", "size",
+		&argparse.Options{Default: 0, Help: "max dictionary size (default or zero means 64k)"})
+	trainDictKeys := trainDictCmd.String("k", "keys",
+		&argparse.Options{Help: "key file of the storage"})
+
+	growCmd := parser.NewCommand("grow", "appends empty chunks to a storage file in place. existing data is left intact. the storage must not be used by a server while growing, use the server admin endpoint instead")
+	growFile := growCmd.String("f", "file",
+		&argparse.Options{Required: true, Help: "storage file to grow, base filename of segments for a segmented storage"})
+	growChunks := growCmd.String("c", "chunks",
+		&argparse.Options{Required: true, Help: "new total number of chunks or +N to add N chunks"})
+
+	rekeyCmd := parser.NewCommand("rekey", "re-encrypts items of a storage file in place with the active (last) key of a key file. the key file must also contain keys the items are currently encrypted with")
+	rekeyFile := rekeyCmd.String("f", "file",
+		&argparse.Options{Required: true, Help: "storage file to re-encrypt, base filename of segments for a segmented storage"})
+	rekeyKeyFile := rekeyCmd.String("k", "keys",
+		&argparse.Options{Required: true, Help: "key file"})
+	rekeyBackup := rekeyCmd.Flag("b", "backup",
+		&argparse.Options{Help: "copy the storage file to <file>.k<key id>.bak before re-encrypting"})
+
+	statsCmd := parser.NewCommand("stats", "shows statistics of live items kept in a storage header")
+	statsFile := statsCmd.File("f", "file", os.O_RDONLY, 0644,
+		&argparse.Options{Required: true, Help: "storage file"})
+	statsDict := statsCmd.String("d", "dict",
+		&argparse.Options{Help: "dictionary file to check against the storage"})
+	statsKeys := statsCmd.String("k", "keys",
+		&argparse.Options{Help: "key file to check against the storage"})
 
 	err := parser.Parse(os.Args)
 
@@ -36,7 +118,35 @@ func main() {
 		runCreate(storageFile, *chunkSize, *numChunks, *storageID)
 	}
 
+	if createSegCmd.Happened() {
+		runCreateSegmented(*segBase, *segChunkSize, *segChunks, *segStorageID)
+	}
+
 	if moveCmd.Happened() {
-		runMove(inputFile, outputFile)
+		runMove(inputFile, outputFile, *moveWorkers, *moveUnordered, *moveDict, *moveKeys, *moveOutDict, *moveOutKeys)
+	}
+
+	if compactCmd.Happened() {
+		runCompact(compactInput, compactOutput, compactMap, *compactChunkSize, *compactNumChunks, *compactWorkers, *compactDict, *compactKeys)
+	}
+
+	if upgradeCmd.Happened() {
+		runUpgrade(*upgradeFile, *upgradeDryRun, *upgradeBackup, *upgradeNoBackup)
+	}
+
+	if trainDictCmd.Happened() {
+		runTrainDict(trainDictInput, trainDictOutput, *trainDictSize, *trainDictKeys)
+	}
+
+	if growCmd.Happened() {
+		runGrow(*growFile, *growChunks)
+	}
+
+	if rekeyCmd.Happened() {
+		runRekey(*rekeyFile, *rekeyKeyFile, *rekeyBackup)
+	}
+
+	if statsCmd.Happened() {
+		runStats(statsFile, *statsDict, *statsKeys)
 	}
 }
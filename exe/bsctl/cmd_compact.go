@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/viert/bookstore/storage"
+)
+
+func runCompact(input *os.File, output *os.File, mapFile *os.File, chunkSize int, numChunks int, workers int,
+	dictFilename string, keyFilename string) {
+	defer output.Close()
+	defer mapFile.Close()
+
+	ist, err := storage.OpenReadOnly(input)
+	if err != nil {
+		log.Fatalf("error opening input storage: %s", err)
+	}
+	configureStorage(ist, dictFilename, keyFilename, true)
+
+	if chunkSize == 0 {
+		chunkSize = ist.GetChunkDataSize()
+	}
+
+	if chunkSize < storage.MinChunkSize || chunkSize > storage.MaxChunkSize {
+		log.Fatalf("chunk size can not be less than %d or greater than %d\n",
+			storage.MinChunkSize, storage.MaxChunkSize)
+	}
+
+	if numChunks == 0 {
+		// keeping the same data capacity as the input storage has
+		numChunks = ist.GetNumChunks() * ist.GetChunkDataSize() / chunkSize
+		if numChunks > storage.MaxNumChunks {
+			numChunks = storage.MaxNumChunks
+		}
+		if numChunks < 1 {
+			numChunks = 1
+		}
+	}
+
+	if numChunks > storage.MaxNumChunks {
+		log.Fatalf("number of chunks can not be greater than %d\n", storage.MaxNumChunks)
+	}
+
+	_, err = storage.CreateStorage(output, chunkSize, numChunks, ist.GetID())
+	if err != nil {
+		log.Fatalf("error creating output storage: %s", err)
+	}
+
+	ost, err := storage.Open(output)
+	if err != nil {
+		log.Fatalf("error opening output storage: %s", err)
+	}
+
+	// the output storage keeps the dictionary and the keyring of the input
+	// so servers configured for the input one can use it
+	if dictFilename != "" {
+		dict, err := ioutil.ReadFile(dictFilename)
+		if err != nil {
+			log.Fatalf("error reading dictionary file: %s", err)
+		}
+		err = ost.AssignDictionary(dict)
+		if err != nil {
+			log.Fatalf("error assigning dictionary: %s", err)
+		}
+	}
+	if keyFilename != "" {
+		ost.SetKeyring(readKeyring(keyFilename))
+	}
+
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// the map file is a tab-separated list of "<old id>\t<new id>" lines
+	mw := bufio.NewWriter(mapFile)
+	count := 0
+	err = ist.ParallelIterItems(workers, true, func(idx int, meta *storage.ItemMeta, r io.Reader) error {
+		newIdx, werr := copyItem(ost, meta, r)
+		if werr != nil {
+			return fmt.Errorf("error writing item %d: %s", idx, werr)
+		}
+		_, werr = fmt.Fprintf(mw, "%d\t%d\n", idx, newIdx)
+		if werr != nil {
+			return fmt.Errorf("error writing map file: %s", werr)
+		}
+		count++
+		return nil
+	})
+
+	if err != nil {
+		log.Fatalf("error compacting data: %s", err)
+	}
+
+	err = mw.Flush()
+	if err != nil {
+		log.Fatalf("error writing map file: %s", err)
+	}
+
+	fmt.Printf("Storage compacted: %s\nItems copied: %d\nChunk data size: %d\nNumber of chunks: %d\nStorage ID: %d\n",
+		output.Name(), count, chunkSize, numChunks, ost.GetID())
+}
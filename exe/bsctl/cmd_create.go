@@ -47,3 +47,25 @@ func runCreate(f *os.File, chunkSize int, numChunks int, storageID int) {
 	fmt.Printf("Storage created: %s\nFile size:  %d bytes\nStorage ID: %d\n", fi.Name(), fi.Size(), st.GetID())
 
 }
+
+func runCreateSegmented(base string, chunkSize int, segmentChunks int, storageID int) {
+	if chunkSize < storage.MinChunkSize || chunkSize > storage.MaxChunkSize {
+		log.Fatalf("chunk size can not be less than %d or greater than %d\n",
+			storage.MinChunkSize, storage.MaxChunkSize)
+	}
+
+	if segmentChunks < 1 {
+		log.Fatalln("number of chunks per segment can not be less than 1")
+	}
+
+	if segmentChunks > storage.MaxNumChunks {
+		log.Fatalf("number of chunks per segment can not be greater than %d\n", storage.MaxNumChunks)
+	}
+
+	id, err := storage.CreateSegmentedStorage(base, chunkSize, segmentChunks, uint64(storageID))
+	if err != nil {
+		log.Fatalf("error creating storage: %s", err)
+	}
+	fmt.Printf("Segmented storage created: %s\nChunks per segment: %d\nStorage ID: %d\n",
+		storage.SegmentFileName(base, 0), segmentChunks, id)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/viert/bookstore/storage"
+)
+
+// parseGrowSize parses either an absolute number of chunks or
+// a number of chunks to add prefixed with "+"
+func parseGrowSize(size string, current int) (int, error) {
+	add := strings.HasPrefix(size, "+")
+	n, err := strconv.Atoi(strings.TrimPrefix(size, "+"))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of chunks '%s'", size)
+	}
+	if add {
+		return current + n, nil
+	}
+	return n, nil
+}
+
+func runGrow(filename string, size string) {
+	f := openBackend(filename, os.O_RDWR)
+	defer f.Close()
+
+	st, err := storage.Open(f)
+	if err != nil {
+		log.Fatalf("error opening storage: %s", err)
+	}
+
+	current := st.GetNumChunks()
+	numChunks, err := parseGrowSize(size, current)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = st.Grow(numChunks, storage.NopGrowCallback)
+	if err != nil {
+		log.Fatalf("error growing storage: %s", err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		log.Fatalf("error syncing storage file: %s", err)
+	}
+
+	fmt.Printf("Storage grown: %s\nChunks: %d -> %d\n", filename, current, st.GetNumChunks())
+}
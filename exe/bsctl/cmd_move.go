@@ -1,25 +1,36 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
+	"runtime"
 
 	"github.com/viert/bookstore/storage"
 )
 
-func runMove(input *os.File, output *os.File) {
-	ist, err := storage.Open(input)
+func runMove(input *os.File, output *os.File, workers int, unordered bool,
+	dictFilename string, keyFilename string, outDictFilename string, outKeyFilename string) {
+	ist, err := storage.OpenReadOnly(input)
 	if err != nil {
 		log.Fatalf("error opening input storage: %s", err)
 	}
+	configureStorage(ist, dictFilename, keyFilename, true)
 
 	ost, err := storage.Open(output)
 	if err != nil {
 		log.Fatalf("error opening output storage: %s", err)
 	}
+	configureStorage(ost, outDictFilename, outKeyFilename, true)
 
-	err = ist.Iter(func(idx int, data []byte) error {
-		_, werr := ost.Write(data, storage.NopReplicationCallback)
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// in unordered mode items are written to the output storage
+	// concurrently so their order isn't kept
+	err = ist.ParallelIterItems(workers, !unordered, func(idx int, meta *storage.ItemMeta, r io.Reader) error {
+		_, werr := copyItem(ost, meta, r)
 		return werr
 	})
 
@@ -27,3 +38,24 @@ func runMove(input *os.File, output *os.File) {
 		log.Fatalf("error copying data: %s", err)
 	}
 }
+
+// copyItem streams an item into the output storage with an item
+// writer so large items are never kept in memory as a whole. Metadata
+// is copied along with the key and expiration time it holds.
+// Returns the index of the copy
+func copyItem(ost *storage.Storage, meta *storage.ItemMeta, r io.Reader) (int, error) {
+	w, err := ost.NewItemWriterMeta(meta, storage.NopReplicationCallback)
+	if err != nil {
+		return -1, err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		w.Abort()
+		return -1, err
+	}
+	err = w.Close()
+	if err != nil {
+		return -1, err
+	}
+	return w.Index(), nil
+}
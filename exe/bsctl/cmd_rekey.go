@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/viert/bookstore/storage"
+)
+
+func runRekey(filename string, keyFilename string, backup bool) {
+	keys := readKeyring(keyFilename)
+
+	f := openBackend(filename, os.O_RDWR)
+	defer f.Close()
+
+	if backup {
+		backupStorage(filename, f, fmt.Sprintf("%s.k%d.bak", filename, keys.ActiveKeyID()))
+	}
+
+	st, err := storage.Open(f)
+	if err != nil {
+		log.Fatalf("error opening storage: %s", err)
+	}
+	st.SetKeyring(keys)
+
+	count, err := st.Rekey()
+	if err != nil {
+		log.Fatalf("error re-encrypting storage (%d chunks done): %s", count, err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		log.Fatalf("error syncing storage file: %s", err)
+	}
+	fmt.Printf("Storage re-encrypted: %s\nActive key ID: %d\nChunks re-encrypted: %d\n", filename, keys.ActiveKeyID(), count)
+}
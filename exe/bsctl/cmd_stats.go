@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/viert/bookstore/storage"
+)
+
+func runStats(f *os.File, dictFilename string, keyFilename string) {
+	defer f.Close()
+
+	st, err := storage.OpenReadOnly(f)
+	if err != nil {
+		log.Fatalf("error opening storage: %s", err)
+	}
+	// statistics are kept in the header, the files given are checked
+	// against the storage only
+	configureStorage(st, dictFilename, keyFilename, false)
+
+	stats, ok := st.Stats()
+	if !ok {
+		log.Fatalln("storage statistics aren't valid, rebuild them with POST /api/v1/admin/rebuild_stats of a server")
+	}
+
+	fill := float64(stats.UsedChunks) * 100 / float64(st.GetNumChunks())
+	var avg float64
+	if stats.Items > 0 {
+		avg = float64(stats.UsedChunks) / float64(stats.Items)
+	}
+	fmt.Printf("Items: %d\nUsed chunks: %d of %d (%.2f%%)\nAverage chunks per item: %.2f\nStored bytes: %d\nRaw bytes: %d\n",
+		stats.Items, stats.UsedChunks, st.GetNumChunks(), fill, avg, stats.StoredBytes, stats.RawBytes)
+	if id := st.DictionaryID(); id != 0 {
+		fmt.Printf("Dictionary ID: %08x\n", id)
+	}
+	if fp := st.KeyringFingerprint(); fp != "" {
+		fmt.Printf("Keyring: %s\n", fp)
+	}
+}
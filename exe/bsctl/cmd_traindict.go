@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/viert/bookstore/storage"
+)
+
+func runTrainDict(input *os.File, output *os.File, size int, keyFilename string) {
+	defer input.Close()
+	defer output.Close()
+
+	if size <= 0 {
+		size = storage.DefaultDictSize
+	}
+
+	st, err := storage.Open(input)
+	if err != nil {
+		log.Fatalf("error opening storage: %s", err)
+	}
+
+	if id := st.DictionaryID(); id != 0 {
+		log.Fatalf("storage already has dictionary %08x", id)
+	}
+	configureStorage(st, "", keyFilename, false)
+
+	dict, err := st.TrainDictionary(size)
+	if err != nil {
+		log.Fatalf("error training dictionary: %s", err)
+	}
+
+	// the dictionary must be safely stored before the storage
+	// starts depending on it
+	_, err = output.Write(dict)
+	if err == nil {
+		err = output.Sync()
+	}
+	if err != nil {
+		log.Fatalf("error writing dictionary file: %s", err)
+	}
+
+	err = st.AssignDictionary(dict)
+	if err != nil {
+		log.Fatalf("error assigning dictionary: %s", err)
+	}
+
+	err = input.Sync()
+	if err != nil {
+		log.Fatalf("error syncing storage file: %s", err)
+	}
+
+	fmt.Printf("Dictionary created: %s\nDictionary ID: %08x\nSize: %d bytes\n", output.Name(), st.DictionaryID(), len(dict))
+	fmt.Println("Set storage.dict in the server config to use it")
+}
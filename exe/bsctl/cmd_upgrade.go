@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/viert/bookstore/storage"
+)
+
+// storageBackend is a storage file or segments of a segmented storage
+type storageBackend interface {
+	storage.Backend
+	Sync() error
+	Close() error
+}
+
+// openBackend opens a storage file. Segmented storages are given by the
+// base name of segments like in the server config, all the segments are
+// opened then so chunks are found in the right segment files
+func openBackend(filename string, flags int) storageBackend {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if _, err := os.Stat(storage.SegmentFileName(filename, 0)); err == nil {
+			sb, err := storage.OpenSegmentedBackend(filename)
+			if err != nil {
+				log.Fatalf("error opening storage segments: %s", err)
+			}
+			return sb
+		}
+	}
+
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		log.Fatalf("error opening storage file: %s", err)
+	}
+	segmented, err := storage.IsSegmented(f)
+	if err != nil {
+		log.Fatalf("error reading storage header: %s", err)
+	}
+	if segmented {
+		log.Fatalf("%s is a segment of a segmented storage, pass the base name of segments instead", filename)
+	}
+	return f
+}
+
+// backupStorage copies a storage file to backupName. Segments of
+// a segmented storage are copied to segments of backupName
+func backupStorage(filename string, b storageBackend, backupName string) {
+	if f, ok := b.(*os.File); ok {
+		err := backupFile(f, backupName)
+		if err != nil {
+			log.Fatalf("error creating backup file: %s", err)
+		}
+		fmt.Printf("Backup created: %s\n", backupName)
+		return
+	}
+
+	for n := 0; ; n++ {
+		f, err := os.Open(storage.SegmentFileName(filename, n))
+		if os.IsNotExist(err) {
+			return
+		}
+		segmentBackup := storage.SegmentFileName(backupName, n)
+		if err == nil {
+			err = backupFile(f, segmentBackup)
+			f.Close()
+		}
+		if err != nil {
+			log.Fatalf("error creating backup file: %s", err)
+		}
+		fmt.Printf("Backup created: %s\n", segmentBackup)
+	}
+}
+
+func backupFile(f *os.File, backupName string) error {
+	bf, err := os.OpenFile(backupName, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+
+	_, err = io.Copy(bf, io.NewSectionReader(f, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	return bf.Sync()
+}
+
+func runUpgrade(filename string, dryRun bool, backup bool, noBackup bool) {
+	flags := os.O_RDWR
+	if dryRun {
+		flags = os.O_RDONLY
+	}
+
+	f := openBackend(filename, flags)
+	defer f.Close()
+
+	version, err := storage.ReadVersion(f)
+	if err != nil {
+		log.Fatalf("error reading storage version: %s", err)
+	}
+
+	steps, err := storage.UpgradeSteps(version)
+	if err != nil {
+		log.Fatalf("can't upgrade storage: %s", err)
+	}
+
+	if len(steps) == 0 {
+		fmt.Printf("Storage %s is up to date (version %d)\n", filename, version)
+		return
+	}
+
+	fmt.Printf("Storage %s has version %d, upgrade steps:\n", filename, version)
+	for _, step := range steps {
+		fmt.Printf("  %s\n", step)
+	}
+
+	if dryRun {
+		return
+	}
+
+	if !backup && !noBackup && !storage.UpgradeRestartable(version) {
+		log.Fatalf("some upgrade steps aren't restartable, run with --backup or --no-backup-i-know")
+	}
+
+	if backup {
+		backupStorage(filename, f, fmt.Sprintf("%s.v%d.bak", filename, version))
+	}
+
+	err = storage.Upgrade(f)
+	if err != nil {
+		log.Fatalf("error upgrading storage: %s", err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		log.Fatalf("error syncing storage file: %s", err)
+	}
+
+	st, err := storage.Open(f)
+	if err != nil {
+		log.Fatalf("error opening upgraded storage: %s", err)
+	}
+	fmt.Printf("Storage upgraded: %s\nStorage ID: %d\n", filename, st.GetID())
+}
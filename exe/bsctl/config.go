@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/viert/bookstore/storage"
+)
+
+// readKeyring reads and parses a key file
+func readKeyring(filename string) *storage.Keyring {
+	keyData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("error reading key file: %s", err)
+	}
+	keys, err := storage.ParseKeyring(keyData)
+	if err != nil {
+		log.Fatalf("error parsing key file: %s", err)
+	}
+	return keys
+}
+
+// configureStorage sets up the dictionary and the keyring of a storage
+// like bsserver does, empty filenames are skipped. If required is set
+// a storage using a dictionary can't go without it
+func configureStorage(st *storage.Storage, dictFilename string, keyFilename string, required bool) {
+	if dictFilename != "" {
+		dict, err := ioutil.ReadFile(dictFilename)
+		if err != nil {
+			log.Fatalf("error reading dictionary file: %s", err)
+		}
+		err = st.SetDictionary(dict)
+		if err != nil {
+			log.Fatalf("error configuring storage: %s", err)
+		}
+	} else if id := st.DictionaryID(); id != 0 && required {
+		log.Fatalf("storage uses dictionary %08x, the dictionary file must be given", id)
+	}
+
+	if keyFilename != "" {
+		st.SetKeyring(readKeyring(keyFilename))
+	}
+}
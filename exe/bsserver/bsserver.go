@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
@@ -43,22 +44,98 @@ func main() {
 	}
 	defer lf.Close()
 
-	storageFile, err := os.OpenFile(cfg.StorageFileName, os.O_RDWR, 0644)
-	if err != nil {
-		log.Fatalf("error opening storage file: %s", err)
+	var backend storage.Backend
+	if cfg.Segmented {
+		sb, err := storage.OpenSegmentedBackend(cfg.StorageFileName)
+		if err != nil {
+			log.Fatalf("error opening storage segments: %s", err)
+		}
+		defer sb.Close()
+		backend = sb
+	} else {
+		storageFile, err := os.OpenFile(cfg.StorageFileName, os.O_RDWR, 0644)
+		if err != nil {
+			log.Fatalf("error opening storage file: %s", err)
+		}
+		backend = storageFile
+
+		if cfg.Mmap {
+			mb, err := storage.NewMmapBackend(storageFile)
+			if err != nil {
+				log.Fatalf("error mapping storage file: %s", err)
+			}
+			defer mb.Close()
+			backend = mb
+		}
 	}
 
-	storage, err := storage.Open(storageFile)
+	st, err := storage.Open(backend)
 	if err != nil {
 		log.Fatalf("error opening storage: %s", err)
 	}
 
-	srv, err := server.NewServer(storage, cfg).Start()
+	durability, err := storage.ParseDurability(cfg.Durability)
+	if err != nil {
+		log.Fatalf("error configuring storage: %s", err)
+	}
+	st.SetDurability(durability, cfg.GroupCommitWindow)
+
+	codec, err := storage.CodecByName(cfg.Codec)
+	if err != nil {
+		log.Fatalf("error configuring storage: %s", err)
+	}
+	st.SetCodec(codec)
+	st.SetCacheSize(cfg.CacheSize)
+
+	if cfg.DictFileName != "" {
+		dict, err := ioutil.ReadFile(cfg.DictFileName)
+		if err != nil {
+			log.Fatalf("error reading dictionary file: %s", err)
+		}
+		err = st.SetDictionary(dict)
+		if err != nil {
+			log.Fatalf("error configuring storage: %s", err)
+		}
+	} else if id := st.DictionaryID(); id != 0 {
+		log.Fatalf("storage uses dictionary %08x, storage.dict must be configured", id)
+	}
+
+	if cfg.KeyFileName != "" {
+		keyData, err := ioutil.ReadFile(cfg.KeyFileName)
+		if err != nil {
+			log.Fatalf("error reading key file: %s", err)
+		}
+		keys, err := storage.ParseKeyring(keyData)
+		if err != nil {
+			log.Fatalf("error parsing key file: %s", err)
+		}
+		st.SetKeyring(keys)
+	}
+
+	bs := server.NewServer(st, cfg)
+	if cfg.KeyIndexFileName != "" {
+		ki, err := storage.OpenKeyIndex(cfg.KeyIndexFileName, st)
+		if err != nil {
+			log.Fatalf("error opening key index: %s", err)
+		}
+		defer ki.Close()
+		bs.SetKeyIndex(ki)
+	}
+	if cfg.DedupIndexFileName != "" {
+		hi, err := storage.OpenHashIndex(cfg.DedupIndexFileName, st)
+		if err != nil {
+			log.Fatalf("error opening dedup index: %s", err)
+		}
+		defer hi.Close()
+		bs.SetHashIndex(hi)
+	}
+
+	srv, err := bs.Start()
 	if err != nil {
 		log.Fatalf("error starting server: %s", err)
 	}
 
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT)
 	defer signal.Reset()
 
@@ -15,18 +15,31 @@ import (
 	"github.com/viert/bookstore/server"
 )
 
+// ttlHeader sets the expiration time of an item put, it's passed
+// to the writer as is
+const ttlHeader = "X-Bookstore-TTL"
+
 type putResponse struct {
 	InstanceID uint64 `json:"instance_id"`
 	ItemID     int    `json:"item_id"`
 }
 
+type deleteResponse struct {
+	InstanceID uint64 `json:"instance_id"`
+	ItemID     int    `json:"item_id"`
+	Deleted    bool   `json:"deleted"`
+}
+
 type errorResponse struct {
 	Error string `json:"error"`
 }
 
-func (rt *Router) putData(r *http.Request) (interface{}, error) {
+type putBatchResponse struct {
+	InstanceID uint64 `json:"instance_id"`
+	ItemIDs    []int  `json:"item_ids"`
+}
 
-	// Checking incoming data
+func readJSONBody(r *http.Request) ([]byte, error) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
 		return nil, common.NewHTTPError(400, "only application/json body is allowed")
@@ -35,13 +48,14 @@ func (rt *Router) putData(r *http.Request) (interface{}, error) {
 	if err != nil {
 		return nil, common.NewHTTPError(400, "error reading body: %s", err)
 	}
-	// Checking data for consistency
-
-	err = json.Unmarshal(data, &server.IncomingData{})
-	if err != nil {
-		return nil, common.NewHTTPError(400, "invalid input data: %s", err)
-	}
+	return data, nil
+}
 
+// postToWriter posts data to a random alive writer retrying with
+// other writers on failures. A non-empty ttl is forwarded in the
+// X-Bookstore-TTL header. Returns the writer's storage id and
+// its response body
+func (rt *Router) postToWriter(path string, data []byte, ttl string) (uint64, []byte, error) {
 	// Getting available writers
 	type writerDesc struct {
 		host      string
@@ -58,19 +72,26 @@ func (rt *Router) putData(r *http.Request) (interface{}, error) {
 	}
 	rt.writerLock.RUnlock()
 
+	if len(availableWriters) == 0 {
+		return 0, nil, common.NewHTTPError(502, "no alive writers available")
+	}
+
 	for retries := 3; retries > 0; retries-- {
 		idx := rand.Intn(len(availableWriters))
 		writer := availableWriters[idx]
 
-		url := fmt.Sprintf("http://%s/api/v1/data/append", writer.host)
+		url := fmt.Sprintf("http://%s%s", writer.host, path)
 		cli := &http.Client{Timeout: rt.storageTimeout}
 		buf := bytes.NewBuffer(data)
 
 		req, err := http.NewRequest("POST", url, buf)
 		if err != nil {
-			return nil, common.NewHTTPError(500, "error creating post request: %s", err)
+			return 0, nil, common.NewHTTPError(500, "error creating post request: %s", err)
 		}
 		req.Header.Set("Content-Type", "application/json")
+		if ttl != "" {
+			req.Header.Set(ttlHeader, ttl)
+		}
 
 		resp, err := cli.Do(req)
 		if err != nil {
@@ -82,24 +103,77 @@ func (rt *Router) putData(r *http.Request) (interface{}, error) {
 			continue
 		}
 
-		data, err := ioutil.ReadAll(resp.Body)
+		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			log.Errorf("error reading response body from %s: %s. retries left %d", url, err, retries-1)
 			continue
 		}
+		return writer.storageID, body, nil
+	}
 
-		var respContent server.WriteDataResponse
-		err = json.Unmarshal(data, &respContent)
-		if err != nil {
-			log.Errorf("error unmarshaling response body from %s: %s. retries left %d", url, err, retries-1)
-			continue
-		}
+	return 0, nil, common.NewHTTPError(500, "can't write data after 3 retries")
+}
+
+func (rt *Router) putData(r *http.Request) (interface{}, error) {
+	data, err := readJSONBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checking data for consistency
+	err = json.Unmarshal(data, &server.IncomingData{})
+	if err != nil {
+		return nil, common.NewHTTPError(400, "invalid input data: %s", err)
+	}
+
+	storageID, body, err := rt.postToWriter("/api/v1/data/append", data, r.Header.Get(ttlHeader))
+	if err != nil {
+		return nil, err
+	}
 
-		outputContent := putResponse{InstanceID: writer.storageID, ItemID: respContent.ID}
-		return outputContent, nil
+	var respContent server.WriteDataResponse
+	err = json.Unmarshal(body, &respContent)
+	if err != nil {
+		log.Errorf("error unmarshaling response body from storage %d: %s", storageID, err)
+		return nil, common.NewHTTPError(500, "error unmarshaling storage response: %s", err)
 	}
 
-	return nil, common.NewHTTPError(500, "can't write data after 3 retries")
+	outputContent := putResponse{InstanceID: storageID, ItemID: respContent.ID}
+	return outputContent, nil
+}
+
+// putBatch writes the whole batch to a single instance so
+// it's committed atomically
+func (rt *Router) putBatch(r *http.Request) (interface{}, error) {
+	data, err := readJSONBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checking data for consistency
+	var batch []server.IncomingData
+	err = json.Unmarshal(data, &batch)
+	if err != nil {
+		return nil, common.NewHTTPError(400, "invalid input data: %s", err)
+	}
+	if len(batch) == 0 {
+		return nil, common.NewHTTPError(400, "input batch is empty")
+	}
+
+	storageID, body, err := rt.postToWriter("/api/v1/data/append_batch", data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var respContent server.WriteBatchResponse
+	err = json.Unmarshal(body, &respContent)
+	if err != nil {
+		log.Errorf("error unmarshaling response body from storage %d: %s", storageID, err)
+		return nil, common.NewHTTPError(500, "error unmarshaling storage response: %s", err)
+	}
+
+	outputContent := putBatchResponse{InstanceID: storageID, ItemIDs: respContent.IDs}
+	return outputContent, nil
 }
 
 func (rt *Router) getData(r *http.Request) (interface{}, error) {
@@ -124,7 +198,7 @@ func (rt *Router) getData(r *http.Request) (interface{}, error) {
 			return nil, common.NewHTTPError(502, "no alive storages available")
 		}
 
-		data, err := rt.proxyData(aliveReaders, itemID)
+		data, err := rt.proxyData(aliveReaders, itemID, r.URL.RawQuery)
 		if err != nil {
 			return nil, err
 		}
@@ -135,3 +209,52 @@ func (rt *Router) getData(r *http.Request) (interface{}, error) {
 	}
 
 }
+
+func (rt *Router) deleteData(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	instanceID, err := strconv.ParseUint(vars["instanceID"], 10, 64)
+	if err != nil {
+		return nil, common.NewHTTPError(400, "invalid instance id")
+	}
+	itemID, err := strconv.Atoi(vars["itemID"])
+	if err != nil {
+		return nil, common.NewHTTPError(400, "invalid item id")
+	}
+
+	// full writers are marked as dead but still accept deletions
+	// so there's no isAlive check here
+	rt.writerLock.RLock()
+	writer, found := rt.writers[instanceID]
+	rt.writerLock.RUnlock()
+	if !found {
+		return nil, common.NewHTTPError(404, "instance not found")
+	}
+
+	url := fmt.Sprintf("http://%s/api/v1/data/%d", writer.host, itemID)
+	cli := &http.Client{Timeout: rt.storageTimeout}
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return nil, common.NewHTTPError(500, "error creating delete request: %s", err)
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		log.Errorf("error deleting data at %s: %s", url, err)
+		return nil, common.NewHTTPError(502, "error deleting data: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, common.NewHTTPError(502, "status code %d from storage", resp.StatusCode)
+		}
+		var errData errorResponse
+		err = json.Unmarshal(content, &errData)
+		if err != nil {
+			return nil, common.NewHTTPError(502, "status code %d from storage", resp.StatusCode)
+		}
+		return nil, common.NewHTTPError(resp.StatusCode, errData.Error)
+	}
+
+	return deleteResponse{InstanceID: instanceID, ItemID: itemID, Deleted: true}, nil
+}
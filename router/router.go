@@ -213,7 +213,9 @@ func (rt *Router) Start() error {
 
 	r := mux.NewRouter()
 	r.HandleFunc("/put", common.JSONResponse(rt.putData)).Methods("POST")
+	r.HandleFunc("/put_batch", common.JSONResponse(rt.putBatch)).Methods("POST")
 	r.HandleFunc("/get/{instanceID}/{itemID}", common.JSONResponse(rt.getData)).Methods("GET")
+	r.HandleFunc("/get/{instanceID}/{itemID}", common.JSONResponse(rt.deleteData)).Methods("DELETE")
 
 	rt.srv = &http.Server{
 		Addr:    rt.bind,
@@ -265,7 +267,15 @@ func (rt *Router) getAppInfo(si *storageInstance) (*server.InfoResponse, error)
 	return &info, nil
 }
 
-func (rt *Router) proxyData(hosts []string, itemID string) (*server.DataListResponse, error) {
+func dataURL(host string, itemID string, query string) string {
+	url := fmt.Sprintf("http://%s/api/v1/data/get/%s", host, itemID)
+	if query != "" {
+		url += "?" + query
+	}
+	return url
+}
+
+func (rt *Router) proxyData(hosts []string, itemID string, query string) (*server.DataListResponse, error) {
 	var responseBody []byte
 	var listResponse server.DataListResponse
 	var err error
@@ -273,7 +283,7 @@ func (rt *Router) proxyData(hosts []string, itemID string) (*server.DataListResp
 	cli := &http.Client{Timeout: rt.storageTimeout}
 	if len(hosts) == 1 {
 		host := hosts[0]
-		url := fmt.Sprintf("http://%s/api/v1/data/get/%s", host, itemID)
+		url := dataURL(host, itemID, query)
 		log.Debugf("getting data from %s", url)
 		resp, err := cli.Get(url)
 		if err != nil {
@@ -289,7 +299,7 @@ func (rt *Router) proxyData(hosts []string, itemID string) (*server.DataListResp
 		for retries := 3; retries > 0; retries-- {
 			idx := rand.Intn(len(hosts))
 			host := hosts[idx]
-			url := fmt.Sprintf("http://%s/api/v1/data/get/%s", host, itemID)
+			url := dataURL(host, itemID, query)
 			log.Debugf("getting data from %s", url)
 			resp, err := cli.Get(url)
 			if err != nil {
@@ -3,13 +3,30 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/viert/bookstore/common"
+	"github.com/viert/bookstore/storage"
+)
+
+const (
+	ttlHeader        = "X-Bookstore-TTL"
+	maxKeySize       = 1024
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+	// items larger than that are returned by scan without data
+	maxScanItemSize = 64 * 1024
+)
+
+var (
+	errNoKeyIndex = common.NewHTTPError(http.StatusNotFound, "key index is not configured")
 )
 
 // InfoResponse is a json-marked-up structure for info handler
@@ -21,15 +38,73 @@ type InfoResponse struct {
 	NumChunks     int    `json:"num_chunks"`
 	ServerType    string `json:"server_type"`
 	IsFull        bool   `json:"is_full"`
+	// items are replicated encoded so compression
+	// and encryption settings must match
+	Codec   string `json:"codec"`
+	DictID  uint32 `json:"dict_id,omitempty"`
+	Keyring string `json:"keyring,omitempty"`
+	// dedup stats are reported when dedup is enabled
+	DedupHits       *int64 `json:"dedup_hits,omitempty"`
+	DedupSavedBytes *int64 `json:"dedup_saved_bytes,omitempty"`
+	// cache stats are reported when the item cache is enabled
+	CacheHits   *int64 `json:"cache_hits,omitempty"`
+	CacheMisses *int64 `json:"cache_misses,omitempty"`
+	// storage stats are reported unless they need to be rebuilt
+	*StatsResponse
 }
 
-// IncomingData is a json-marked-up structure for incoming data
+// StatsResponse is a json-marked-up structure for storage statistics.
+// FillPercent is the share of chunks used by live items
+type StatsResponse struct {
+	Items            int64   `json:"items"`
+	UsedChunks       int64   `json:"used_chunks"`
+	StoredBytes      int64   `json:"stored_bytes"`
+	RawBytes         int64   `json:"raw_bytes"`
+	AvgChunksPerItem float64 `json:"avg_chunks_per_item"`
+	FillPercent      float64 `json:"fill_percent"`
+}
+
+func (s *Server) statsResponse(stats storage.Stats) *StatsResponse {
+	resp := &StatsResponse{
+		Items:       stats.Items,
+		UsedChunks:  stats.UsedChunks,
+		StoredBytes: stats.StoredBytes,
+		RawBytes:    stats.RawBytes,
+		FillPercent: float64(stats.UsedChunks) * 100 / float64(s.storage.GetNumChunks()),
+	}
+	if stats.Items > 0 {
+		resp.AvgChunksPerItem = float64(stats.UsedChunks) / float64(stats.Items)
+	}
+	return resp
+}
+
+// IncomingData is a json-marked-up structure for incoming data.
+// Meta is optional, the storage fills in its length and codec
 type IncomingData struct {
-	Data string `json:"data"`
+	Data string            `json:"data"`
+	Meta *storage.ItemMeta `json:"meta,omitempty"`
+}
+
+// ReplicatedItem is a json-marked-up structure for items replicated by
+// master in the form they're stored. Key is set for items stored under
+// a key so replicas keep their key indices
+type ReplicatedItem struct {
+	ID   int                  `json:"id"`
+	Key  string               `json:"key,omitempty"`
+	Item *storage.EncodedItem `json:"item"`
 }
 
+// WriteDataResponse is a json-marked-up structure for write handlers.
+// Durability holds the guarantee actually provided by the storage
 type WriteDataResponse struct {
-	ID int `json:"id"`
+	ID         int    `json:"id"`
+	Durability string `json:"durability,omitempty"`
+}
+
+// WriteBatchResponse is a json-marked-up structure for batch write handlers
+type WriteBatchResponse struct {
+	IDs        []int  `json:"ids"`
+	Durability string `json:"durability,omitempty"`
 }
 
 func (s *Server) appInfo(r *http.Request) (interface{}, error) {
@@ -37,7 +112,7 @@ func (s *Server) appInfo(r *http.Request) (interface{}, error) {
 	if s.role == roleMaster {
 		srvType = "master"
 	}
-	return &InfoResponse{
+	info := &InfoResponse{
 		AppName:       "bookstore",
 		StorageID:     s.storage.GetID(),
 		ChunkSize:     s.storage.GetChunkSize(),
@@ -45,51 +120,193 @@ func (s *Server) appInfo(r *http.Request) (interface{}, error) {
 		NumChunks:     s.storage.GetNumChunks(),
 		ServerType:    srvType,
 		IsFull:        s.storage.IsFull(),
-	}, nil
+		Codec:         s.storage.CodecName(),
+		DictID:        s.storage.DictionaryID(),
+		Keyring:       s.storage.KeyringFingerprint(),
+	}
+	if s.hashes != nil {
+		hits, saved := s.hashes.Hits(), s.hashes.SavedBytes()
+		info.DedupHits = &hits
+		info.DedupSavedBytes = &saved
+	}
+	if s.storage.CacheEnabled() {
+		hits, misses := s.storage.CacheStats()
+		info.CacheHits = &hits
+		info.CacheMisses = &misses
+	}
+	if stats, ok := s.storage.Stats(); ok {
+		info.StatsResponse = s.statsResponse(stats)
+	}
+	return info, nil
+}
+
+// GrowRequest is a json-marked-up structure for grow handler. Either
+// the new total number of chunks or the number of chunks to add is set
+type GrowRequest struct {
+	NumChunks int `json:"num_chunks,omitempty"`
+	Add       int `json:"add,omitempty"`
+}
+
+// GrowResponse is a json-marked-up structure for grow handler
+type GrowResponse struct {
+	NumChunks int `json:"num_chunks"`
 }
 
+// DataItem is an item returned by data handlers. Large is set
+// by scan for items returned without data
 type DataItem struct {
-	ID   int    `json:"id"`
-	Data string `json:"data"`
+	ID    int               `json:"id"`
+	Meta  *storage.ItemMeta `json:"meta,omitempty"`
+	Data  string            `json:"data"`
+	Large bool              `json:"large,omitempty"`
 }
 
 type DataListResponse struct {
 	Items []*DataItem `json:"items"`
 }
 
-func (s *Server) getData(r *http.Request) (interface{}, error) {
+// DataScanResponse is a json-marked-up structure for scan handler.
+// Next is the cursor of the next page, -1 if there are no more items
+type DataScanResponse struct {
+	Items []*DataItem `json:"items"`
+	Next  int         `json:"next"`
+}
+
+func itemReadError(idx int, err error) error {
+	if _, ok := err.(storage.ChecksumError); ok {
+		// the item is corrupted on this instance only so the error
+		// mustn't look like a generic failure and clients (i.e. router)
+		// may retry it on another instance
+		return common.NewHTTPError(http.StatusServiceUnavailable, "item %d is corrupted: %s", idx, err)
+	}
+	// storage methods are supposed to return HTTPError
+	return err
+}
+
+// getData streams items as a DataListResponse json. Items are opened
+// before anything is written so missing items are reported properly,
+// errors happening while streaming abort the connection. Metadata
+// is included if requested with ?meta=1
+func (s *Server) getData(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	tokens := strings.Split(vars["id"], ",")
 
-	dlr := &DataListResponse{Items: make([]*DataItem, 0)}
+	ids := make([]int, 0, len(tokens))
 	for _, token := range tokens {
 		id, err := strconv.ParseInt(token, 10, 32)
 		if err != nil {
-			return nil, common.HTTPError{
+			common.WriteJSONError(w, common.HTTPError{
 				Code:    http.StatusBadRequest,
 				Message: fmt.Sprintf("invalid id '%s'", token),
-			}
+			})
+			return
 		}
+		ids = append(ids, int(id))
+	}
+
+	s.writeItems(w, ids, r.URL.Query().Get("meta") == "1")
+}
+
+// writeItems streams items as a DataListResponse json
+func (s *Server) writeItems(w http.ResponseWriter, ids []int, withMeta bool) {
+	readers := make([]io.ReadCloser, 0, len(ids))
+	metas := make([]*storage.ItemMeta, 0, len(ids))
+	defer func() {
+		for _, rd := range readers {
+			rd.Close()
+		}
+	}()
 
-		data, err := s.storage.Read(int(id))
+	for _, id := range ids {
+		rd, meta, err := s.storage.OpenItemMeta(id)
 		if err != nil {
-			// storage methods are supposed to return HTTPError
-			return nil, err
+			common.WriteJSONError(w, itemReadError(id, err))
+			return
 		}
+		readers = append(readers, rd)
+		metas = append(metas, meta)
+	}
 
-		item := &DataItem{
-			ID:   int(id),
-			Data: string(data),
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"items":[`)
+	for i, rd := range readers {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		fmt.Fprintf(w, `{"id":%d,`, ids[i])
+		if withMeta && metas[i] != nil {
+			meta, _ := json.Marshal(metas[i])
+			fmt.Fprintf(w, `"meta":%s,`, meta)
 		}
-		dlr.Items = append(dlr.Items, item)
+		io.WriteString(w, `"data":"`)
+		jw := common.NewJSONStringWriter(w)
+		_, err := io.Copy(jw, rd)
+		if err == nil {
+			err = jw.Close()
+		}
+		if err != nil {
+			log.Errorf("error streaming item %d: %s", ids[i], itemReadError(ids[i], err))
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, `"}`)
 	}
-	return dlr, nil
+	io.WriteString(w, "]}")
 }
 
-func getIncomingData(r *http.Request) (*IncomingData, error) {
+func queryInt(r *http.Request, name string, dflt int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return dflt, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, common.NewHTTPError(http.StatusBadRequest, "invalid %s '%s'", name, value)
+	}
+	return int(n), nil
+}
+
+// scanData returns a page of items starting from ?from= cursor,
+// up to ?limit= items, walking backwards if ?reverse=1 is given.
+// Items larger than maxScanItemSize are returned without data
+// and have to be read by id
+func (s *Server) scanData(r *http.Request) (interface{}, error) {
+	reverse := r.URL.Query().Get("reverse") == "1"
+	dfltFrom := 0
+	if reverse {
+		dfltFrom = -1
+	}
+	from, err := queryInt(r, "from", dfltFrom)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(r, "limit", defaultScanLimit)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > maxScanLimit {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and %d", maxScanLimit)
+	}
+
+	items, next, err := s.storage.Scan(from, limit, maxScanItemSize, reverse)
+	if err != nil {
+		return nil, itemReadError(from, err)
+	}
+
+	withMeta := r.URL.Query().Get("meta") == "1"
+	resp := &DataScanResponse{Items: make([]*DataItem, len(items)), Next: next}
+	for i, item := range items {
+		resp.Items[i] = &DataItem{ID: item.Idx, Data: string(item.Data), Large: item.Large}
+		if withMeta {
+			resp.Items[i].Meta = item.Meta
+		}
+	}
+	return resp, nil
+}
+
+func readJSONBody(r *http.Request, v interface{}) error {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		return nil, common.HTTPError{
+		return common.HTTPError{
 			Message: "this handler accepts JSON data only",
 			Code:    http.StatusBadRequest,
 		}
@@ -97,20 +314,28 @@ func getIncomingData(r *http.Request) (*IncomingData, error) {
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, common.HTTPError{
+		return common.HTTPError{
 			Message: fmt.Sprintf("error reading request body: %s", err),
 			Code:    http.StatusInternalServerError,
 		}
 	}
 
-	var input IncomingData
-	err = json.Unmarshal(body, &input)
+	err = json.Unmarshal(body, v)
 	if err != nil {
-		return nil, common.HTTPError{
+		return common.HTTPError{
 			Message: fmt.Sprintf("error parsing json data: %s", err),
 			Code:    http.StatusBadRequest,
 		}
 	}
+	return nil
+}
+
+func getIncomingData(r *http.Request) (*IncomingData, error) {
+	var input IncomingData
+	err := readJSONBody(r, &input)
+	if err != nil {
+		return nil, err
+	}
 
 	if input.Data == "" {
 		return nil, common.HTTPError{
@@ -122,17 +347,92 @@ func getIncomingData(r *http.Request) (*IncomingData, error) {
 	return &input, nil
 }
 
+// applyTTL sets the expiration time of an item to be written if
+// X-Bookstore-TTL header is given. TTL is either a number of seconds
+// or a duration like "72h". Expiration time is stored as uint32 unix
+// time so TTLs reaching past it are rejected
+func applyTTL(r *http.Request, input *IncomingData) error {
+	value := r.Header.Get(ttlHeader)
+	if value == "" {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	maxTTL := time.Unix(math.MaxUint32, 0).Sub(now)
+
+	var ttl time.Duration
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		if seconds > int64(maxTTL/time.Second) {
+			return common.NewHTTPError(http.StatusBadRequest, "%s '%s' is too large", ttlHeader, value)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	} else {
+		ttl, err = time.ParseDuration(value)
+	}
+	if err != nil || ttl <= 0 {
+		return common.NewHTTPError(http.StatusBadRequest, "invalid %s '%s'", ttlHeader, value)
+	}
+	if ttl > maxTTL {
+		return common.NewHTTPError(http.StatusBadRequest, "%s '%s' is too large", ttlHeader, value)
+	}
+
+	if input.Meta == nil {
+		input.Meta = new(storage.ItemMeta)
+	}
+	expires := now.Add(ttl).Truncate(time.Second)
+	input.Meta.Expires = &expires
+	return nil
+}
+
 func (s *Server) appendData(r *http.Request) (interface{}, error) {
 	input, err := getIncomingData(r)
 	if err != nil {
 		return nil, err
 	}
+	err = applyTTL(r, input)
+	if err != nil {
+		return nil, err
+	}
 
-	idx, err := s.storage.Write([]byte(input.Data), func(idx int) error {
+	return s.writeItem(input)
+}
+
+// writeItem appends an item to the storage. An item stored under
+// a key replaces the previous item stored under the same key. With dedup
+// enabled items without metadata identical to a stored one aren't written,
+// the existing item ID is returned instead
+func (s *Server) writeItem(input *IncomingData) (*WriteDataResponse, error) {
+	data := []byte(input.Data)
+	if s.hashes != nil && input.Meta == nil {
+		if idx, found := s.hashes.Find(data); found {
+			return &WriteDataResponse{ID: idx, Durability: s.storage.Durability().String()}, nil
+		}
+	}
+
+	if input.Meta != nil {
+		// creation time is set by master so replicas store the same metadata
+		input.Meta.Created = time.Now().UTC()
+		if input.Meta.Key != "" && s.keys == nil {
+			return nil, errNoKeyIndex
+		}
+	}
+
+	item, err := s.storage.EncodeItem(data, input.Meta)
+	if err != nil {
+		// storage methods are supposed to return HTTPError
+		return nil, err
+	}
+	var key string
+	if input.Meta != nil {
+		key = input.Meta.Key
+	}
+
+	idx, err := s.storage.WriteEncodedTo(item, -1, func(idx int) error {
 		if !s.replicate {
 			return nil
 		}
-		return s.doReplication(idx, input)
+		return s.doReplication(&ReplicatedItem{ID: idx, Key: key, Item: item})
 	})
 
 	if err != nil {
@@ -142,9 +442,37 @@ func (s *Server) appendData(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	return &WriteDataResponse{ID: idx}, nil
+	if s.hashes != nil && input.Meta == nil {
+		err = s.hashes.Add(data, idx)
+		if err != nil {
+			// the item is stored anyway, it just won't be deduplicated
+			log.Errorf("error indexing item %d: %s", idx, err)
+		}
+	}
+
+	if input.Meta != nil && input.Meta.Key != "" {
+		prev, found, err := s.keys.Set(input.Meta.Key, idx)
+		if err != nil {
+			return nil, common.NewHTTPError(http.StatusInternalServerError, "%s", err)
+		}
+		if found {
+			err = s.storage.Delete(prev, func(idx int) error {
+				if !s.replicate {
+					return nil
+				}
+				return s.doDeleteReplication(idx)
+			})
+			// the new item is stored already, the old one is just garbage
+			if err != nil {
+				log.Errorf("error deleting item %d replaced by key %s: %s", prev, input.Meta.Key, err)
+			}
+		}
+	}
+
+	return &WriteDataResponse{ID: idx, Durability: s.storage.Durability().String()}, nil
 }
 
+// setData stores an item replicated by master as is
 func (s *Server) setData(r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 
@@ -156,16 +484,21 @@ func (s *Server) setData(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	input, err := getIncomingData(r)
+	var input ReplicatedItem
+	err = readJSONBody(r, &input)
 	if err != nil {
 		return nil, err
 	}
+	if input.Item == nil {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "replicated item is empty")
+	}
+	input.ID = int(idx)
 
-	_, err = s.storage.WriteTo([]byte(input.Data), int(idx), func(idx int) error {
+	_, err = s.storage.WriteEncodedTo(input.Item, int(idx), func(idx int) error {
 		if !s.replicate {
 			return nil
 		}
-		return s.doReplication(idx, input)
+		return s.doReplication(&input)
 	})
 
 	if err != nil {
@@ -175,6 +508,214 @@ func (s *Server) setData(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	return &WriteDataResponse{ID: int(idx)}, nil
+	// replaced items are deleted by master, deletions are replicated separately
+	if input.Key != "" && s.keys != nil {
+		_, _, err = s.keys.Set(input.Key, int(idx))
+		if err != nil {
+			return nil, common.NewHTTPError(http.StatusInternalServerError, "%s", err)
+		}
+	}
+
+	return &WriteDataResponse{ID: int(idx), Durability: s.storage.Durability().String()}, nil
 
 }
+
+// deleteData deletes an item. Master serves it as DELETE /api/v1/data/{id},
+// replicas accept deletions only from master the same way setData does
+func (s *Server) deleteData(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+
+	idx, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		return nil, common.HTTPError{
+			Message: fmt.Sprintf("invalid id '%s'", vars["id"]),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	err = s.storage.Delete(int(idx), func(idx int) error {
+		if !s.replicate {
+			return nil
+		}
+		return s.doDeleteReplication(idx)
+	})
+
+	if err != nil {
+		// storage methods are supposed to return HTTPError
+		return nil, err
+	}
+
+	return &WriteDataResponse{ID: int(idx), Durability: s.storage.Durability().String()}, nil
+}
+
+func (s *Server) appendBatch(r *http.Request) (interface{}, error) {
+	var input []IncomingData
+	err := readJSONBody(r, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input) == 0 {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "input batch is empty")
+	}
+
+	items := make([]*storage.EncodedItem, len(input))
+	for i, item := range input {
+		if item.Data == "" {
+			return nil, common.NewHTTPError(http.StatusBadRequest, "input data of item %d is empty", i)
+		}
+		if item.Meta != nil {
+			return nil, common.NewHTTPError(http.StatusBadRequest, "metadata is not supported in batches")
+		}
+		items[i], err = s.storage.EncodeItem([]byte(item.Data), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idxs, err := s.storage.WriteEncodedBatchTo(items, nil, func(idxs []int) error {
+		if !s.replicate {
+			return nil
+		}
+		batch := make([]ReplicatedItem, len(items))
+		for i, item := range items {
+			batch[i] = ReplicatedItem{ID: idxs[i], Item: item}
+		}
+		return s.doBatchReplication(batch)
+	})
+
+	if err != nil {
+		return nil, common.HTTPError{
+			Message: fmt.Sprintf("error writing data to storage: %s", err),
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	return &WriteBatchResponse{IDs: idxs, Durability: s.storage.Durability().String()}, nil
+}
+
+// setBatch stores a batch of items replicated by master as is
+func (s *Server) setBatch(r *http.Request) (interface{}, error) {
+	var input []ReplicatedItem
+	err := readJSONBody(r, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*storage.EncodedItem, len(input))
+	idxs := make([]int, len(input))
+	for i, item := range input {
+		if item.Item == nil {
+			return nil, common.NewHTTPError(http.StatusBadRequest, "replicated item %d is empty", i)
+		}
+		items[i] = item.Item
+		idxs[i] = item.ID
+	}
+
+	_, err = s.storage.WriteEncodedBatchTo(items, idxs, func(idxs []int) error {
+		if !s.replicate {
+			return nil
+		}
+		return s.doBatchReplication(input)
+	})
+
+	if err != nil {
+		return nil, common.HTTPError{
+			Message: fmt.Sprintf("error writing data to storage: %s", err),
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	return &WriteBatchResponse{IDs: idxs, Durability: s.storage.Durability().String()}, nil
+}
+
+// putKey stores an item under an application key
+func (s *Server) putKey(r *http.Request) (interface{}, error) {
+	if s.keys == nil {
+		return nil, errNoKeyIndex
+	}
+
+	key := mux.Vars(r)["key"]
+	if len(key) > maxKeySize {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "key is too long, max length is %d", maxKeySize)
+	}
+
+	input, err := getIncomingData(r)
+	if err != nil {
+		return nil, err
+	}
+	err = applyTTL(r, input)
+	if err != nil {
+		return nil, err
+	}
+	if input.Meta == nil {
+		input.Meta = new(storage.ItemMeta)
+	}
+	input.Meta.Key = key
+
+	return s.writeItem(input)
+}
+
+// getKey streams the item stored under an application key
+// the same way getData does
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		common.WriteJSONError(w, errNoKeyIndex)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	idx, found := s.keys.Get(key)
+	if found {
+		// the item may have expired and its chunks may have been reused
+		meta, err := s.storage.ReadMeta(idx)
+		found = err == nil && meta != nil && meta.Key == key
+	}
+	if !found {
+		common.WriteJSONError(w, common.NewHTTPError(http.StatusNotFound, "key %s not found", key))
+		return
+	}
+	s.writeItems(w, []int{idx}, r.URL.Query().Get("meta") == "1")
+}
+
+func (s *Server) growStorage(r *http.Request) (interface{}, error) {
+	var input GrowRequest
+	err := readJSONBody(r, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	numChunks := input.NumChunks
+	if input.Add > 0 {
+		if numChunks > 0 {
+			return nil, common.NewHTTPError(http.StatusBadRequest, "num_chunks and add can't be set at once")
+		}
+		numChunks = s.storage.GetNumChunks() + input.Add
+	}
+	if numChunks <= 0 {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "either num_chunks or add must be set")
+	}
+
+	err = s.storage.Grow(numChunks, func(numChunks int) error {
+		if !s.replicate {
+			return nil
+		}
+		return s.doGrowReplication(numChunks)
+	})
+
+	if err != nil {
+		// storage methods are supposed to return HTTPError
+		return nil, err
+	}
+
+	return &GrowResponse{NumChunks: s.storage.GetNumChunks()}, nil
+}
+
+// rebuildStats recounts storage statistics walking all the items
+func (s *Server) rebuildStats(r *http.Request) (interface{}, error) {
+	stats, err := s.storage.RebuildStats()
+	if err != nil {
+		return nil, err
+	}
+	return s.statsResponse(stats), nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/op/go-logging"
 
@@ -30,8 +31,18 @@ type Server struct {
 	role        roleType
 	replicate   bool
 	replicateTo string
+	keys        *storage.KeyIndex
+	hashes      *storage.HashIndex
+	// reapInterval is the interval between deletions of expired
+	// items made by master, zero disables them
+	reapInterval time.Duration
 
 	replClient *http.Client
+	// adminClient is used for replicating slow admin operations
+	// which can't fit into the replication timeout. Grow holds the
+	// storage write lock while it's replicated so the timeout is
+	// still bounded
+	adminClient *http.Client
 }
 
 var (
@@ -51,6 +62,7 @@ func NewServer(storage *storage.Storage, cfg *config.ServerCfg) *Server {
 
 	if cfg.IsMaster {
 		s.role = roleMaster
+		s.reapInterval = cfg.ReapInterval
 		rtype = "master"
 	}
 
@@ -60,18 +72,32 @@ func NewServer(storage *storage.Storage, cfg *config.ServerCfg) *Server {
 		s.replClient = &http.Client{
 			Timeout: cfg.ReplicationTimeout,
 		}
+		s.adminClient = &http.Client{
+			Timeout: cfg.AdminTimeout,
+		}
 	}
 
 	log.Infof("Server configured as %s", rtype)
 	return s
 }
 
+// SetKeyIndex enables storing and fetching items by application keys
+func (s *Server) SetKeyIndex(ki *storage.KeyIndex) {
+	s.keys = ki
+}
+
+// SetHashIndex enables deduplication of appended items
+func (s *Server) SetHashIndex(hi *storage.HashIndex) {
+	s.hashes = hi
+}
+
 func (s *Server) checkReplication() error {
 	log.Info("Checking replication...")
 	resp, err := s.replClient.Get(fmt.Sprintf("%s/api/v1/info", s.replicateTo))
 	if err != nil {
 		return fmt.Errorf("error getting server info from replica: %s", err)
 	}
+	defer resp.Body.Close()
 
 	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -106,6 +132,19 @@ func (s *Server) checkReplication() error {
 		return fmt.Errorf("master and replica's storage IDs don't match")
 	}
 
+	// items are replicated compressed and stored as is
+	log.Infof("Local codec is %s, replica codec is %s", s.storage.CodecName(), info.Codec)
+	if info.Codec != s.storage.CodecName() {
+		return fmt.Errorf("master and replica's codecs don't match")
+	}
+	if info.DictID != s.storage.DictionaryID() {
+		return fmt.Errorf("master and replica's dictionary IDs don't match: %08x and %08x",
+			s.storage.DictionaryID(), info.DictID)
+	}
+	if info.Keyring != s.storage.KeyringFingerprint() {
+		return fmt.Errorf("master and replica's keyrings don't match")
+	}
+
 	return nil
 }
 
@@ -121,16 +160,29 @@ func (s *Server) Start() (*http.Server, error) {
 		}
 	}
 
+	if _, ok := s.storage.Stats(); !ok {
+		log.Warning("storage statistics aren't valid, rebuild them with POST /api/v1/admin/rebuild_stats")
+	}
+
 	log.Info("Creating HTTP router")
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/v1/info", common.JSONResponse(s.appInfo)).Methods("GET")
-	r.HandleFunc("/api/v1/data/get/{id}", common.JSONResponse(s.getData)).Methods("GET")
+	r.HandleFunc("/api/v1/data/get/{id}", s.getData).Methods("GET")
+	r.HandleFunc("/api/v1/data/scan", common.JSONResponse(s.scanData)).Methods("GET")
+	r.HandleFunc("/api/v1/keys/{key}", s.getKey).Methods("GET")
+	r.HandleFunc("/api/v1/admin/grow", common.JSONResponse(s.growStorage)).Methods("POST")
+	r.HandleFunc("/api/v1/admin/rebuild_stats", common.JSONResponse(s.rebuildStats)).Methods("POST")
 
 	if s.role == roleMaster {
 		r.HandleFunc("/api/v1/data/append", common.JSONResponse(s.appendData)).Methods("POST")
+		r.HandleFunc("/api/v1/data/append_batch", common.JSONResponse(s.appendBatch)).Methods("POST")
+		r.HandleFunc("/api/v1/keys/{key}", common.JSONResponse(s.putKey)).Methods("PUT")
+		r.HandleFunc("/api/v1/data/{id}", common.JSONResponse(s.deleteData)).Methods("DELETE")
 	} else {
 		r.HandleFunc("/api/v1/data/set/{id}", common.JSONResponse(s.setData)).Methods("POST")
+		r.HandleFunc("/api/v1/data/set_batch", common.JSONResponse(s.setBatch)).Methods("POST")
+		r.HandleFunc("/api/v1/data/delete/{id}", common.JSONResponse(s.deleteData)).Methods("POST")
 	}
 
 	srv := &http.Server{
@@ -146,18 +198,76 @@ func (s *Server) Start() (*http.Server, error) {
 		}
 	}()
 
+	if s.reapInterval > 0 {
+		stop := make(chan struct{})
+		srv.RegisterOnShutdown(func() { close(stop) })
+		go s.runReaper(stop)
+	}
+
 	return srv, nil
 }
 
-func (s *Server) doReplication(idx int, data *IncomingData) error {
+// runReaper periodically deletes expired items. Deletions are replicated
+// the same way deleteData does so replicas don't run their own reapers.
+// The reaper stops when stop is closed on server shutdown
+func (s *Server) runReaper(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		count, err := s.storage.ReapExpired(func(idx int) error {
+			if !s.replicate {
+				return nil
+			}
+			return s.doDeleteReplication(idx)
+		})
+		if err != nil {
+			log.Errorf("error deleting expired items: %s", err)
+		}
+		if count > 0 {
+			log.Infof("%d expired items deleted", count)
+		}
+	}
+}
+
+func (s *Server) doReplication(item *ReplicatedItem) error {
+
+	jd, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	bodyReader := bytes.NewBuffer(jd)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/data/set/%d", s.replicateTo, item.ID), bodyReader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.replClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-ok status code from replica: %d", resp.StatusCode)
+	}
+
+	return nil
+}
 
-	jd, err := json.Marshal(data)
+func (s *Server) doBatchReplication(batch []ReplicatedItem) error {
+	jd, err := json.Marshal(batch)
 	if err != nil {
 		return err
 	}
 
 	bodyReader := bytes.NewBuffer(jd)
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/data/set/%d", s.replicateTo, idx), bodyReader)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/data/set_batch", s.replicateTo), bodyReader)
 	if err != nil {
 		return err
 	}
@@ -167,6 +277,52 @@ func (s *Server) doReplication(idx int, data *IncomingData) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-ok status code from replica: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *Server) doDeleteReplication(idx int) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/data/delete/%d", s.replicateTo, idx), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.replClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// an item which is already deleted on replica is ok, this
+	// happens when a previous deletion has failed locally
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusGone {
+		return fmt.Errorf("non-ok status code from replica: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *Server) doGrowReplication(numChunks int) error {
+	jd, err := json.Marshal(&GrowRequest{NumChunks: numChunks})
+	if err != nil {
+		return err
+	}
+
+	bodyReader := bytes.NewBuffer(jd)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/admin/grow", s.replicateTo), bodyReader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("non-ok status code from replica: %d", resp.StatusCode)
 	}
@@ -6,6 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -39,6 +44,12 @@ file = /dev/zero`
 )
 
 func startServer(storageID uint64, configString string) (*http.Server, error) {
+	return startIndexedServer(storageID, configString, "", "")
+}
+
+// startIndexedServer starts a server with key and dedup indexes
+// kept in given files, an empty filename disables the index
+func startIndexedServer(storageID uint64, configString string, keyIndexFile string, hashIndexFile string) (*http.Server, error) {
 	mb := storage.NewMemBackend()
 	_, err := storage.CreateStorage(mb, 512, 512, storageID)
 	if err != nil {
@@ -55,13 +66,47 @@ func startServer(storageID uint64, configString string) (*http.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	srv, err := NewServer(st, cfg).Start()
+	st.SetCacheSize(cfg.CacheSize)
+	codec, err := storage.CodecByName(cfg.Codec)
+	if err != nil {
+		return nil, err
+	}
+	st.SetCodec(codec)
+	bs := NewServer(st, cfg)
+	if keyIndexFile != "" {
+		ki, err := storage.OpenKeyIndex(keyIndexFile, st)
+		if err != nil {
+			return nil, err
+		}
+		bs.SetKeyIndex(ki)
+	}
+	if hashIndexFile != "" {
+		hi, err := storage.OpenHashIndex(hashIndexFile, st)
+		if err != nil {
+			return nil, err
+		}
+		bs.SetHashIndex(hi)
+	}
+	srv, err := bs.Start()
 	if err != nil {
 		return nil, err
 	}
 	return srv, nil
 }
 
+// waitServer waits until the server at port is ready to serve requests
+func waitServer(port int) error {
+	var err error
+	for i := 0; i < 50; i++ {
+		_, err = doGetInfo(port)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
 func startMaster(storageID uint64) (*http.Server, error) {
 	return startServer(storageID, masterCfg)
 }
@@ -75,7 +120,7 @@ func startStandalone(storageID uint64) (*http.Server, error) {
 }
 
 func makeInputBody(data string) ([]byte, error) {
-	input := &incomingData{Data: data}
+	input := &IncomingData{Data: data}
 	return json.Marshal(input)
 }
 
@@ -103,10 +148,154 @@ func doPostRequest(data string, port int, path string) error {
 	return nil
 }
 
+func doAppendBatchRequest(items []string, port int) (*WriteBatchResponse, error) {
+	cli := &http.Client{Timeout: 250 * time.Millisecond}
+	batch := make([]IncomingData, len(items))
+	for i, data := range items {
+		batch[i] = IncomingData{Data: data}
+	}
+	input, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://localhost:%d/api/v1/data/append_batch", port)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(input))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-ok status code from master: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var wbr WriteBatchResponse
+	err = json.Unmarshal(body, &wbr)
+	if err != nil {
+		return nil, err
+	}
+	return &wbr, nil
+}
+
 func doAppendRequest(data string, port int) error {
 	return doPostRequest(data, port, "/api/v1/data/append")
 }
 
+func doAppendData(data string, port int) (int, error) {
+	input, err := makeInputBody(data)
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("http://localhost:%d/api/v1/data/append", port)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(input))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("non-ok status code from master: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	var wr WriteDataResponse
+	err = json.Unmarshal(body, &wr)
+	return wr.ID, err
+}
+
+func doDeleteRequest(idx int, port int) (int, error) {
+	cli := &http.Client{Timeout: 250 * time.Millisecond}
+	url := fmt.Sprintf("http://localhost:%d/api/v1/data/%d", port, idx)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func doGrowRequest(add int, port int) (int, error) {
+	input, err := json.Marshal(&GrowRequest{Add: add})
+	if err != nil {
+		return 0, err
+	}
+
+	url := fmt.Sprintf("http://localhost:%d/api/v1/admin/grow", port)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(input))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("non-ok status code from master: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	var gr GrowResponse
+	err = json.Unmarshal(body, &gr)
+	if err != nil {
+		return 0, err
+	}
+	return gr.NumChunks, nil
+}
+
+func doGetInfo(port int) (*InfoResponse, error) {
+	url := fmt.Sprintf("http://localhost:%d/api/v1/info", port)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var info InfoResponse
+	err = json.Unmarshal(body, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func doGetMeta(idx int, port int) (*storage.ItemMeta, error) {
+	url := fmt.Sprintf("http://localhost:%d/api/v1/data/get/%d?meta=1", port, idx)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var data DataListResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Items) != 1 {
+		return nil, fmt.Errorf("invalid number of items received: %d", len(data.Items))
+	}
+	return data.Items[0].Meta, nil
+}
+
 func doGetData(idx int, port int) (string, error) {
 	url := fmt.Sprintf("http://localhost:%d/api/v1/data/get/%d", port, idx)
 	resp, err := http.Get(url)
@@ -151,6 +340,10 @@ func TestReplication(t *testing.T) {
 	} else {
 		defer m.Shutdown(nil)
 	}
+	err = waitServer(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	err = doAppendRequest("my first data", 4000)
 	if err != nil {
@@ -170,3 +363,649 @@ func TestReplication(t *testing.T) {
 		t.Error("master and replicationn data don't match")
 	}
 }
+
+func TestReplicationMismatch(t *testing.T) {
+	// items are replicated compressed so codecs must match
+	r, err := startServer(properStorageID, replicaCfg+"\ncodec = zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown(nil)
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startMaster(properStorageID)
+	if err == nil {
+		m.Shutdown(nil)
+		t.Error("master should refuse a replica with another codec")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	r, err := startReplica(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer r.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startMaster(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer m.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	err = doAppendRequest("data to be deleted", 4000)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// replicas accept deletions from master only
+	code, err := doDeleteRequest(0, 4001)
+	if err != nil {
+		t.Error(err)
+	}
+	if code == http.StatusOK {
+		t.Error("delete on replica is expected to be rejected")
+	}
+	_, err = doGetData(0, 4001)
+	if err != nil {
+		t.Errorf("item must stay on replica after rejected delete, got %s", err)
+	}
+
+	code, err = doDeleteRequest(0, 4000)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("delete is expected to return 200, got %d instead", code)
+	}
+
+	_, err = doGetData(0, 4000)
+	if err == nil {
+		t.Error("reading deleted item from master should cause an error")
+	}
+	_, err = doGetData(0, 4001)
+	if err == nil {
+		t.Error("reading deleted item from replica should cause an error")
+	}
+
+	code, err = doDeleteRequest(0, 4000)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusGone {
+		t.Errorf("second delete is expected to return 410, got %d instead", code)
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	r, err := startReplica(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer r.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startMaster(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer m.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	items := []string{"first item", "second item", "third item"}
+	wbr, err := doAppendBatchRequest(items, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wbr.IDs) != len(items) {
+		t.Fatalf("%d ids expected, got %d instead", len(items), len(wbr.IDs))
+	}
+
+	for i, idx := range wbr.IDs {
+		replData, err := doGetData(idx, 4001)
+		if err != nil {
+			t.Error(err)
+		}
+		if replData != items[i] {
+			t.Errorf("replica data of item %d doesn't match", idx)
+		}
+	}
+}
+
+func TestGrow(t *testing.T) {
+	r, err := startReplica(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer r.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startMaster(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer m.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	err = doAppendRequest("data written before growing", 4000)
+	if err != nil {
+		t.Error(err)
+	}
+
+	numChunks, err := doGrowRequest(100, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numChunks != 612 {
+		t.Errorf("storage is expected to have 612 chunks, got %d instead", numChunks)
+	}
+
+	for _, port := range []int{4000, 4001} {
+		info, err := doGetInfo(port)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.NumChunks != numChunks {
+			t.Errorf("server at %d is expected to have %d chunks, got %d instead", port, numChunks, info.NumChunks)
+		}
+	}
+
+	data, err := doGetData(0, 4001)
+	if err != nil {
+		t.Error(err)
+	}
+	if data != "data written before growing" {
+		t.Error("data must be left intact by growing")
+	}
+}
+
+func TestGrowReplicaTimeout(t *testing.T) {
+	r, err := startReplica(properStorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown(nil)
+	if err = waitServer(4001); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replica is reached through a proxy which hangs on grow
+	target, _ := url.Parse("http://127.0.0.1:4001")
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	hang := make(chan struct{})
+	defer close(hang)
+	ps := &http.Server{
+		Addr: "127.0.0.1:4002",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasSuffix(req.URL.Path, "/admin/grow") {
+				<-hang
+				return
+			}
+			proxy.ServeHTTP(w, req)
+		}),
+	}
+	go ps.ListenAndServe()
+	defer ps.Close()
+	if err = waitServer(4002); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := strings.Replace(masterCfg, "4001", "4002", 1) + "\nadmin_timeout = 1"
+	m, err := startServer(properStorageID, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown(nil)
+	if err = waitServer(4000); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = doGrowRequest(100, 4000)
+	if err == nil {
+		t.Error("grow is expected to fail when replica hangs")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("grow is expected to give up on the replica in a second, took %s", elapsed)
+	}
+
+	// writes aren't blocked once grow has given up
+	err = doAppendRequest("data written after failed grow", 4000)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	r, err := startReplica(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer r.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startMaster(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer m.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	input, _ := json.Marshal(&IncomingData{
+		Data: `{"hello":"world"}`,
+		Meta: &storage.ItemMeta{ContentType: "application/json"},
+	})
+	resp, err := http.Post("http://localhost:4000/api/v1/data/append", "application/json", bytes.NewBuffer(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("non-ok status code from master: %d", resp.StatusCode)
+	}
+
+	masterMeta, err := doGetMeta(0, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replMeta, err := doGetMeta(0, 4001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterMeta == nil || replMeta == nil {
+		t.Fatal("metadata is expected to be returned")
+	}
+	if masterMeta.ContentType != "application/json" || masterMeta.Length != 17 {
+		t.Errorf("stored metadata doesn't match: %+v", masterMeta)
+	}
+	if !masterMeta.Created.Equal(replMeta.Created) {
+		t.Error("master and replica metadata don't match")
+	}
+
+	data, err := doGetData(0, 4000)
+	if err != nil {
+		t.Error(err)
+	}
+	if data != `{"hello":"world"}` {
+		t.Error("written and stored data don't match")
+	}
+}
+
+func doPutKey(key string, data string) (int, error) {
+	input, err := makeInputBody(data)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("PUT", "http://localhost:4000/api/v1/keys/"+key, bytes.NewBuffer(input))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("non-ok status code from master: %d", resp.StatusCode)
+	}
+
+	var wr WriteDataResponse
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	err = json.Unmarshal(body, &wr)
+	return wr.ID, err
+}
+
+func doGetKey(key string, port int) (*DataItem, error) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/keys/%s", port, key))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-ok status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var data DataListResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Items) != 1 {
+		return nil, fmt.Errorf("invalid number of items received: %d", len(data.Items))
+	}
+	return data.Items[0], nil
+}
+
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := startIndexedServer(properStorageID, replicaCfg, dir+"/replica.idx", "")
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer r.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startIndexedServer(properStorageID, masterCfg, dir+"/master.idx", "")
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer m.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	first, err := doPutKey("user-1", "first version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := doPutKey("user-1", "second version")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, port := range []int{4000, 4001} {
+		item, err := doGetKey("user-1", port)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if item.ID != second || item.Data != "second version" {
+			t.Errorf("key should point to the second item %d, got item %d %q", second, item.ID, item.Data)
+		}
+
+		// replaced items are deleted
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/data/get/%d", port, first))
+		if err != nil {
+			t.Error(err)
+		} else if resp.StatusCode != http.StatusGone {
+			t.Errorf("replaced item should be deleted, got status %d", resp.StatusCode)
+		}
+	}
+
+	_, err = doGetKey("user-2", 4000)
+	if err == nil {
+		t.Error("unknown key shouldn't be found")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := startIndexedServer(properStorageID, standaloneCfg, "", dir+"/sha256.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(nil)
+	time.Sleep(100 * time.Millisecond)
+
+	ids := make([]int, 3)
+	for i, data := range []string{"payload", "payload", "another payload"} {
+		ids[i], err = doAppendData(data, 3999)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("identical payloads should be stored once, got ids %d and %d", ids[0], ids[1])
+	}
+	if ids[2] == ids[0] {
+		t.Error("different payloads should be stored separately")
+	}
+
+	info, err := doGetInfo(3999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DedupHits == nil || *info.DedupHits != 1 {
+		t.Errorf("one dedup hit expected, got %v", info.DedupHits)
+	}
+	if info.DedupSavedBytes == nil || *info.DedupSavedBytes != int64(len("payload")) {
+		t.Errorf("saved bytes should be %d, got %v", len("payload"), info.DedupSavedBytes)
+	}
+}
+
+func doScan(port int, query string) (*DataScanResponse, error) {
+	url := fmt.Sprintf("http://localhost:%d/api/v1/data/scan?%s", port, query)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-ok response code from server: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var data DataScanResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func TestScan(t *testing.T) {
+	srv, err := startStandalone(properStorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(nil)
+	time.Sleep(100 * time.Millisecond)
+
+	ids := make([]int, 5)
+	for i := range ids {
+		ids[i], err = doAppendData(fmt.Sprintf("item %d", i), 3999)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := doScan(3999, "limit=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 3 || page.Items[0].ID != ids[0] || page.Items[2].Data != "item 2" {
+		t.Errorf("first page is expected to hold the first 3 items, got %v", page.Items)
+	}
+	page, err = doScan(3999, fmt.Sprintf("limit=3&from=%d", page.Next))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[1].ID != ids[4] || page.Next != -1 {
+		t.Errorf("second page is expected to hold the last 2 items, got %v next %d", page.Items, page.Next)
+	}
+
+	page, err = doScan(3999, "limit=2&reverse=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[0].ID != ids[4] || page.Items[1].ID != ids[3] {
+		t.Errorf("reverse page is expected to hold the last 2 items, got %v", page.Items)
+	}
+
+	_, err = doScan(3999, "limit=0")
+	if err == nil {
+		t.Error("zero limit should be rejected")
+	}
+
+	large, err := doAppendData(strings.Repeat("large item ", maxScanItemSize/10), 3999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = doScan(3999, fmt.Sprintf("from=%d", large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != large || !page.Items[0].Large || page.Items[0].Data != "" {
+		t.Errorf("item larger than %d bytes is expected to be returned without data, got %v", maxScanItemSize, page.Items)
+	}
+}
+
+func TestStats(t *testing.T) {
+	srv, err := startStandalone(properStorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(nil)
+	time.Sleep(100 * time.Millisecond)
+
+	for _, data := range []string{"first item", "second item"} {
+		_, err = doAppendData(data, 3999)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := doGetInfo(3999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.StatsResponse == nil {
+		t.Fatal("storage statistics should be reported")
+	}
+	if info.Items != 2 || info.UsedChunks != 2 || info.AvgChunksPerItem != 1 || info.FillPercent <= 0 {
+		t.Errorf("unexpected statistics %+v", *info.StatsResponse)
+	}
+
+	resp, err := http.Post("http://localhost:3999/api/v1/admin/rebuild_stats", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats StatsResponse
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != *info.StatsResponse {
+		t.Errorf("rebuilt statistics %+v don't match reported ones %+v", stats, *info.StatsResponse)
+	}
+}
+
+func doAppendTTL(data string, ttl string, port int) (*http.Response, error) {
+	input, err := makeInputBody(data)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("http://localhost:%d/api/v1/data/append", port)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(input))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bookstore-TTL", ttl)
+	return http.DefaultClient.Do(req)
+}
+
+func TestTTL(t *testing.T) {
+	r, err := startReplica(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer r.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m, err := startMaster(properStorageID)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer m.Shutdown(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := doAppendTTL("session dump", "72h", 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("non-ok status code from master: %d", resp.StatusCode)
+	}
+
+	masterMeta, err := doGetMeta(0, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replMeta, err := doGetMeta(0, 4001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterMeta.Expires == nil || replMeta.Expires == nil {
+		t.Fatal("expiration time is expected to be stored")
+	}
+	if d := time.Until(*masterMeta.Expires); d < 71*time.Hour || d > 72*time.Hour {
+		t.Errorf("item is expected to expire in 72h, got %s", d)
+	}
+	if !masterMeta.Expires.Equal(*replMeta.Expires) {
+		t.Error("master and replica expiration times don't match")
+	}
+
+	// expiration times past 2106 don't fit into the chunk header
+	for _, ttl := range []string{"-1", "0", "tomorrow", "9223372036", "99999999999999999999", "900000h"} {
+		resp, err = doAppendTTL("session dump", ttl, 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("TTL %q should be rejected, got status %d", ttl, resp.StatusCode)
+		}
+	}
+}
+
+func TestReaperStops(t *testing.T) {
+	reaping := func() bool {
+		buf := make([]byte, 1<<20)
+		return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "runReaper")
+	}
+
+	m, err := startServer(properStorageID, standaloneCfg+"reap_interval = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitServer(3999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reaping() {
+		t.Error("reaper is expected to be running")
+	}
+	m.Shutdown(nil)
+
+	for i := 0; i < 50 && reaping(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reaping() {
+		t.Error("reaper is expected to stop on server shutdown")
+	}
+}
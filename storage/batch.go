@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"github.com/viert/bookstore/common"
+)
+
+// BatchReplicationCallback represents a replication callback for
+// batch writes. It receives indices of all the items of a batch
+type BatchReplicationCallback func(idxs []int) error
+
+// NopBatchReplicationCallback is a batch replication callback doing nothing
+func NopBatchReplicationCallback(idxs []int) error {
+	return nil
+}
+
+// WriteBatch writes all the items into free chunks of storage and
+// replicates them with a single callback call.
+// Either all the items are committed or none of them
+func (s *Storage) WriteBatch(items [][]byte, callback BatchReplicationCallback) ([]int, error) {
+	return s.WriteBatchTo(items, nil, callback)
+}
+
+// WriteBatchTo writes a batch of items starting from given indices.
+// If idxs is nil, the items are placed into free chunks
+func (s *Storage) WriteBatchTo(items [][]byte, idxs []int, callback BatchReplicationCallback) ([]int, error) {
+	encoded := make([]*EncodedItem, len(items))
+	for i, data := range items {
+		item, err := s.EncodeItem(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = item
+	}
+	return s.WriteEncodedBatchTo(encoded, idxs, callback)
+}
+
+// WriteEncodedBatchTo writes a batch of items encoded with EncodeItem
+// like WriteBatchTo does
+func (s *Storage) WriteEncodedBatchTo(items []*EncodedItem, idxs []int, callback BatchReplicationCallback) ([]int, error) {
+	if idxs != nil && len(idxs) != len(items) {
+		return nil, common.NewHTTPError(400, "%d indices given for %d items", len(idxs), len(items))
+	}
+	for _, item := range items {
+		err := s.checkEncoded(item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idxs, err := s.writeBatch(items, idxs, callback)
+	if err != nil {
+		log.Errorf("error writing batch to storage: %s", err)
+		return nil, err
+	}
+
+	err = s.sync()
+	if err != nil {
+		log.Errorf("error syncing storage: %s", err)
+		return nil, common.NewHTTPError(500, "error syncing storage: %s", err)
+	}
+	return idxs, nil
+}
+
+func (s *Storage) writeBatch(items []*EncodedItem, idxs []int, callback BatchReplicationCallback) ([]int, error) {
+	if idxs == nil {
+		return s.appendBatch(items, callback)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.waitPending()
+
+	for i, item := range items {
+		err := s.ensureChunk(idxs[i] + s.chunksNeeded(len(item.Payload)) - 1)
+		if err == nil {
+			err = s.checkRoom(idxs[i], item)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replaced := make([]itemStats, len(items))
+	rerrs := make([]error, len(items))
+	for i := range items {
+		replaced[i], rerrs[i] = s.liveItemStats(idxs[i])
+	}
+
+	// nothing written here is visible until commit so a failure
+	// at any point leaves the storage as it was
+	var err error
+	chains := make([][]int, 0, len(items))
+	for i, item := range items {
+		var flags uint8
+		if idxs[i] < int(s.header.FreeChunkIdx) {
+			flags = chunkDeleted
+		}
+		var chunks []int
+		chunks, err = s.writeChunks(item, idxs[i], flags)
+		if err != nil {
+			// the first chunk may be written already
+			chains = append(chains, []int{idxs[i]})
+			break
+		}
+		chains = append(chains, chunks)
+	}
+
+	if err == nil && callback != nil {
+		err = callback(idxs)
+		if err != nil {
+			err = common.NewHTTPError(500, "replication error: %s", err)
+		}
+	}
+	if err != nil {
+		for _, chunks := range chains {
+			s.clearUncommitted(chunks[0])
+		}
+		return nil, err
+	}
+
+	err = s.commit(chains)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, chunks := range chains {
+		s.removeStats(idxs[i], replaced[i], rerrs[i])
+		s.addStats(idxs[i], items[i].stats(len(chunks)), 1)
+	}
+	err = s.writeHeader()
+	if err != nil {
+		log.Errorf("error writing storage header: %s", err)
+		return nil, common.NewHTTPError(500, "error writing storage header: %s", err)
+	}
+	return idxs, nil
+}
+
+// appendBatch reserves chunks for all the items at once, then writes and
+// replicates them without holding the locks like appendItem does
+func (s *Storage) appendBatch(items []*EncodedItem, callback BatchReplicationCallback) ([]int, error) {
+	var err error
+	rs := make([]*reservation, 0, len(items))
+	idxs := make([]int, 0, len(items))
+
+	s.writeLock.Lock()
+	s.locker.Lock()
+	for _, item := range items {
+		var r *reservation
+		r, err = s.reserve(s.chunksNeeded(len(item.Payload)))
+		if err != nil {
+			break
+		}
+		r.stats = item.stats(r.count)
+		rs = append(rs, r)
+		idxs = append(idxs, r.start)
+	}
+	s.locker.Unlock()
+	s.writeLock.Unlock()
+
+	// nothing written here is visible until the reservations
+	// are completed so a failure leaves the storage as it was
+	for i := 0; err == nil && i < len(rs); i++ {
+		_, err = s.writeChunks(items[i], rs[i].start, rs[i].chunkFlags())
+	}
+	if err == nil && callback != nil {
+		err = callback(idxs)
+		if err != nil {
+			err = common.NewHTTPError(500, "replication error: %s", err)
+		}
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	err = s.complete(rs, err)
+	if err != nil {
+		return nil, err
+	}
+	return idxs, nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheItemFraction limits the size of a single cached item
+// to the given fraction of the cache size
+const cacheItemFraction = 16
+
+type cacheEntry struct {
+	idx       int
+	data      []byte
+	meta      *ItemMeta
+	expiresAt uint32
+}
+
+// itemCache is a byte-bounded LRU cache of uncompressed items
+// keyed by their indexes
+type itemCache struct {
+	maxBytes int
+	size     int
+	lru      *list.List
+	entries  map[int]*list.Element
+	// gen is increased on every invalidation so readers opened
+	// before it don't put stale data into the cache
+	gen    uint64
+	lock   sync.Mutex
+	hits   int64
+	misses int64
+}
+
+func newItemCache(maxBytes int) *itemCache {
+	return &itemCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[int]*list.Element),
+	}
+}
+
+func (c *itemCache) get(idx int) (*cacheEntry, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, found := c.entries[idx]; found {
+		c.lru.MoveToFront(el)
+		atomic.AddInt64(&c.hits, 1)
+		return el.Value.(*cacheEntry), c.gen
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return nil, c.gen
+}
+
+// put adds an item to the cache unless it has been invalidated
+// since gen was obtained
+func (c *itemCache) put(gen uint64, entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, found := c.entries[entry.idx]; found {
+		c.remove(el)
+	}
+	c.entries[entry.idx] = c.lru.PushFront(entry)
+	c.size += len(entry.data)
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *itemCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.idx)
+	c.size -= len(entry.data)
+}
+
+func (c *itemCache) invalidate(idx int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	if el, found := c.entries[idx]; found {
+		c.remove(el)
+	}
+}
+
+// cachingReader reads an item putting it to the cache once it's
+// read to the end. Items too large for the cache are just streamed
+type cachingReader struct {
+	ir    *itemReader
+	cache *itemCache
+	gen   uint64
+	idx   int
+	buf   []byte
+	limit int
+}
+
+func (cr *cachingReader) Read(p []byte) (int, error) {
+	n, err := cr.ir.Read(p)
+	if cr.buf != nil {
+		if len(cr.buf)+n > cr.limit {
+			cr.buf = nil
+		} else {
+			cr.buf = append(cr.buf, p[:n]...)
+		}
+	}
+	if err == io.EOF && cr.buf != nil {
+		entry := &cacheEntry{
+			idx:       cr.idx,
+			data:      cr.buf,
+			meta:      cr.ir.meta,
+			expiresAt: cr.ir.chain.head.ExpiresAt,
+		}
+		cr.cache.put(cr.gen, entry)
+		cr.buf = nil
+	}
+	return n, err
+}
+
+func (cr *cachingReader) Close() error {
+	return cr.ir.Close()
+}
+
+// SetCacheSize enables caching of up to maxBytes of uncompressed items
+// read with Read, OpenItem and OpenItemMeta. Zero disables the cache.
+// Like SetDurability it's supposed to be called right after the storage
+// is opened
+func (s *Storage) SetCacheSize(maxBytes int) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.cache = nil
+	if maxBytes > 0 {
+		s.cache = newItemCache(maxBytes)
+	}
+}
+
+// CacheStats returns the number of cache hits and misses, both are
+// zero if the cache is disabled
+func (s *Storage) CacheStats() (int64, int64) {
+	if s.cache == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&s.cache.hits), atomic.LoadInt64(&s.cache.misses)
+}
+
+// CacheEnabled returns true if the item cache is enabled
+func (s *Storage) CacheEnabled() bool {
+	return s.cache != nil
+}
+
+// invalidateCache drops the item starting at idx from the cache.
+// It's called with locker held whenever an item is overwritten or deleted,
+// after its chunks are rewritten so no reader may cache the old data
+func (s *Storage) invalidateCache(idx int) {
+	if s.cache != nil {
+		s.cache.invalidate(idx)
+	}
+}
+
+// openCached returns a reader of the item starting at idx
+// serving it from the cache if possible. Expired items are
+// reported as not found
+func (s *Storage) openCached(idx int) (io.ReadCloser, *ItemMeta, error) {
+	if s.cache == nil {
+		ir, err := s.openLiveItem(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ir, ir.meta, nil
+	}
+
+	entry, gen := s.cache.get(idx)
+	if entry != nil {
+		if isExpired(entry.expiresAt, time.Now()) {
+			return nil, nil, errExpired(idx)
+		}
+		return ioutil.NopCloser(bytes.NewReader(entry.data)), entry.meta, nil
+	}
+
+	ir, err := s.openLiveItem(idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &cachingReader{
+		ir:    ir,
+		cache: s.cache,
+		gen:   gen,
+		idx:   idx,
+		buf:   make([]byte, 0, 4096),
+		limit: s.cache.maxBytes / cacheItemFraction,
+	}
+	return cr, ir.meta, nil
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec IDs stored in chunk headers. IDs 0 and 1 match the former
+// "compressed" flag so older files are read as is
+const (
+	CodecNone  uint8 = 0
+	CodecGzip  uint8 = 1
+	CodecZstd  uint8 = 2
+	CodecS2    uint8 = 3
+	CodecFlate uint8 = 4
+	// CodecZstdDict is zstd with the dictionary assigned to the storage
+	CodecZstdDict uint8 = 5
+)
+
+// Codec represents a compression algorithm. Codec ID is recorded
+// in every chunk so items compressed with different codecs may
+// coexist in the same storage
+type Codec interface {
+	ID() uint8
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecs      = make(map[uint8]Codec)
+	codecsNamed = make(map[string]Codec)
+)
+
+// RegisterCodec makes a codec available for reading and writing items.
+// It panics if a codec with the same ID or name is already registered
+func RegisterCodec(c Codec) {
+	if _, found := codecs[c.ID()]; found {
+		panic(fmt.Sprintf("codec id %d is already registered", c.ID()))
+	}
+	if _, found := codecsNamed[c.Name()]; found {
+		panic(fmt.Sprintf("codec '%s' is already registered", c.Name()))
+	}
+	codecs[c.ID()] = c
+	codecsNamed[c.Name()] = c
+}
+
+// CodecByName returns a registered codec by its name
+func CodecByName(name string) (Codec, error) {
+	c, found := codecsNamed[name]
+	if !found {
+		return nil, fmt.Errorf("unknown codec '%s', must be one of %v", name, CodecNames())
+	}
+	return c, nil
+}
+
+// CodecNames returns a sorted list of registered codec names
+func CodecNames() []string {
+	names := make([]string, 0, len(codecsNamed))
+	for name := range codecsNamed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func codecByID(id uint8) (Codec, error) {
+	c, found := codecs[id]
+	if !found {
+		return nil, fmt.Errorf("unknown codec id %d", id)
+	}
+	return c, nil
+}
+
+// compress compresses data with a given codec as a whole
+func compress(c Codec, data []byte) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	cw, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = cw.Write(data)
+	if err != nil {
+		cw.Close()
+		return nil, err
+	}
+	err = cw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() uint8    { return CodecNone }
+func (noneCodec) Name() string { return "none" }
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8    { return CodecGzip }
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdPool keeps zstd encoders and decoders for reuse since building
+// them takes much longer than compressing a small item. Items are
+// compressed and read one by one so background goroutines would be
+// just an overhead
+type zstdPool struct {
+	encOpts  []zstd.EOption
+	decOpts  []zstd.DOption
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func newZstdPool(encOpts []zstd.EOption, decOpts []zstd.DOption) *zstdPool {
+	return &zstdPool{
+		encOpts: append([]zstd.EOption{zstd.WithEncoderConcurrency(1)}, encOpts...),
+		decOpts: append([]zstd.DOption{zstd.WithDecoderConcurrency(1)}, decOpts...),
+	}
+}
+
+func (p *zstdPool) newWriter(w io.Writer) (io.WriteCloser, error) {
+	zw, ok := p.encoders.Get().(*zstd.Encoder)
+	if !ok {
+		var err error
+		zw, err = zstd.NewWriter(w, p.encOpts...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		zw.Reset(w)
+	}
+	return &zstdWriter{Encoder: zw, pool: p}, nil
+}
+
+func (p *zstdPool) newReader(r io.Reader) (io.ReadCloser, error) {
+	zr, ok := p.decoders.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		zr, err = zstd.NewReader(r, p.decOpts...)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return &zstdReader{Decoder: zr, pool: p}, nil
+}
+
+// zstdWriter returns its encoder to the pool once it's closed
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *zstdPool
+}
+
+func (zw *zstdWriter) Close() error {
+	if zw.Encoder == nil {
+		return nil
+	}
+	err := zw.Encoder.Close()
+	if err == nil {
+		// the destination isn't kept by a pooled encoder
+		zw.Encoder.Reset(nil)
+		zw.pool.encoders.Put(zw.Encoder)
+	}
+	zw.Encoder = nil
+	return err
+}
+
+// zstdReader makes zstd.Decoder an io.ReadCloser returning
+// the decoder to the pool once it's closed
+type zstdReader struct {
+	*zstd.Decoder
+	pool *zstdPool
+}
+
+func (zr *zstdReader) Close() error {
+	if zr.Decoder == nil {
+		return nil
+	}
+	if zr.Decoder.Reset(nil) == nil {
+		zr.pool.decoders.Put(zr.Decoder)
+	}
+	zr.Decoder = nil
+	return nil
+}
+
+var zstdCodecPool = newZstdPool(nil, nil)
+
+type zstdCodec struct{}
+
+func (zstdCodec) ID() uint8    { return CodecZstd }
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstdCodecPool.newWriter(w)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zstdCodecPool.newReader(r)
+}
+
+// s2Codec writes snappy-compatible streams so the data may be
+// read with any snappy implementation
+type s2Codec struct{}
+
+func (s2Codec) ID() uint8    { return CodecS2 }
+func (s2Codec) Name() string { return "s2" }
+
+func (s2Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(w, s2.WriterSnappyCompat(), s2.WriterConcurrency(1)), nil
+}
+
+func (s2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(s2.NewReader(r)), nil
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() uint8    { return CodecFlate }
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(zstdCodec{})
+	RegisterCodec(s2Codec{})
+	RegisterCodec(flateCodec{})
+}
+
+// SetCodec sets the codec new items are compressed with. Items already
+// written keep their codecs. Like SetDurability it's supposed to be
+// called right after the storage is opened
+func (s *Storage) SetCodec(c Codec) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.codec = c
+}
+
+// CodecName returns the name of the codec new items are compressed with
+func (s *Storage) CodecName() string {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.codec.Name()
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// KeySize is the size of AES-256 keys
+	KeySize = 32
+	// gcmOverhead is the size of the authentication tag appended
+	// to every encrypted chunk
+	gcmOverhead = 16
+)
+
+// Keyring holds encryption keys by their IDs. New chunks are encrypted
+// with the active key, any key of the ring can be used for decryption
+type Keyring struct {
+	keys        map[uint8]cipher.AEAD
+	active      uint8
+	fingerprint []byte
+}
+
+// ParseKeyring parses a key file. Every non-empty line not starting
+// with # holds a key id (1 to 255) and a hex-encoded 256-bit key separated
+// by whitespace. The last key listed is the active one
+func ParseKeyring(data []byte) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[uint8]cipher.AEAD)}
+	digest := sha256.New()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Fields(line)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("line %d: key id and key expected", lineNum)
+		}
+		id, err := strconv.ParseUint(tokens[0], 10, 8)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("line %d: invalid key id '%s', must be 1 to 255", lineNum, tokens[0])
+		}
+		key, err := hex.DecodeString(tokens[1])
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("line %d: key must be %d hex-encoded bytes", lineNum, KeySize)
+		}
+		if _, found := kr.keys[uint8(id)]; found {
+			return nil, fmt.Errorf("line %d: duplicate key id %d", lineNum, id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		kr.keys[uint8(id)] = aead
+		kr.active = uint8(id)
+		digest.Write([]byte{uint8(id)})
+		digest.Write(key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(kr.keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	kr.fingerprint = digest.Sum(nil)[:8]
+	return kr, nil
+}
+
+// ActiveKeyID returns the id of the key new chunks are encrypted with
+func (kr *Keyring) ActiveKeyID() uint8 {
+	return kr.active
+}
+
+// Fingerprint identifies keys of the ring and their order without
+// revealing them, rings of master and replica must match
+func (kr *Keyring) Fingerprint() string {
+	return hex.EncodeToString(kr.fingerprint)
+}
+
+// chunkAD returns additional authenticated data of a chunk binding its
+// ciphertext to the chunk position and the chain
+func chunkAD(idx int, header *chunkHeader) []byte {
+	ad := make([]byte, 9)
+	binaryLayout.PutUint32(ad, uint32(idx))
+	binaryLayout.PutUint32(ad[4:], uint32(header.Next))
+	ad[8] = header.Codec
+	return ad
+}
+
+// seal encrypts chunk data with the active key setting KeyID
+// and Nonce of the chunk header
+func (kr *Keyring) seal(idx int, header *chunkHeader, data []byte) ([]byte, error) {
+	_, err := rand.Read(header.Nonce[:])
+	if err != nil {
+		return nil, fmt.Errorf("error generating nonce: %s", err)
+	}
+	header.KeyID = kr.active
+	aead := kr.keys[kr.active]
+	return aead.Seal(make([]byte, 0, len(data)+gcmOverhead), header.Nonce[:], data, chunkAD(idx, header)), nil
+}
+
+// open decrypts chunk data appending the result to dst
+func (kr *Keyring) open(dst []byte, idx int, header *chunkHeader, data []byte) ([]byte, error) {
+	aead, found := kr.keys[header.KeyID]
+	if !found {
+		return nil, fmt.Errorf("chunk %d is encrypted with unknown key %d", idx, header.KeyID)
+	}
+	plain, err := aead.Open(dst, header.Nonce[:], data, chunkAD(idx, header))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting chunk %d: %s", idx, err)
+	}
+	return plain, nil
+}
+
+// SetKeyring enables encryption of new chunks with the active key of
+// the ring and decryption of chunks encrypted with any of its keys.
+// Like SetDurability it's supposed to be called right after the storage
+// is opened
+func (s *Storage) SetKeyring(kr *Keyring) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.keys = kr
+}
+
+// KeyringFingerprint returns the fingerprint of the keyring set
+// with SetKeyring, an empty string if there's none
+func (s *Storage) KeyringFingerprint() string {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if s.keys == nil {
+		return ""
+	}
+	return s.keys.Fingerprint()
+}
+
+// decryptChunk returns plain data of a chunk, data is returned as is
+// if the chunk is not encrypted. Plain data is appended to dst
+func (s *Storage) decryptChunk(dst []byte, idx int, header *chunkHeader, data []byte) ([]byte, error) {
+	if header.KeyID == 0 {
+		return data, nil
+	}
+	if s.keys == nil {
+		return nil, fmt.Errorf("chunk %d is encrypted but no keys are loaded", idx)
+	}
+	return s.keys.open(dst, idx, header, data)
+}
+
+// chunkPayloadSize returns how much item data fits into a chunk
+func (s *Storage) chunkPayloadSize() int {
+	if s.keys != nil {
+		return s.GetChunkDataSize() - gcmOverhead
+	}
+	return s.GetChunkDataSize()
+}
+
+// Rekey re-encrypts chunks of all the items encrypted with keys other
+// than the active one so the old keys may be retired. Chunks are rewritten
+// in place one by one. Unencrypted chunks are left as is since there may
+// be no room for the authentication tag. Returns the number of chunks
+// re-encrypted
+func (s *Storage) Rekey() (int, error) {
+	if s.keys == nil {
+		return 0, fmt.Errorf("no keys are loaded")
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	count := 0
+	for idx := 0; idx < s.highWaterMark(); idx++ {
+		done, err := s.rekeyChunk(idx)
+		if err != nil {
+			return count, err
+		}
+		if done {
+			count++
+		}
+	}
+
+	err := s.sync()
+	if err != nil {
+		return count, fmt.Errorf("error syncing storage: %s", err)
+	}
+	return count, nil
+}
+
+func (s *Storage) rekeyChunk(idx int) (bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	header, err := s.readChunkHeader(idx)
+	if err != nil {
+		return false, err
+	}
+	if header.isDeleted() || header.KeyID == 0 || header.KeyID == s.keys.active {
+		return false, nil
+	}
+
+	data := make([]byte, header.DataSize)
+	_, err = s.backend.ReadAt(data, int64(s.getChunkPosition(idx)+chunkHeaderSize))
+	if err != nil {
+		return false, fmt.Errorf("error reading chunk %d: %s", idx, err)
+	}
+	plain, err := s.decryptChunk(nil, idx, header, data)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.writeChunk(idx, header, plain)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
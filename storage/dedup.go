@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// HashIndex maps SHA-256 hashes of item data to indexes of the items
+// so identical payloads may be stored once. Only items without metadata
+// are indexed since metadata is unique to every write. A lost index file
+// is rebuilt by hashing all the items of the storage
+type HashIndex struct {
+	s          *Storage
+	index      *sidecarIndex
+	hits       int64
+	savedBytes int64
+}
+
+func dataHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// OpenHashIndex opens the hash index file of a storage. If the file
+// doesn't exist it's rebuilt from the storage items
+func OpenHashIndex(filename string, s *Storage) (*HashIndex, error) {
+	index, err := openSidecarIndex(filename, func(entries map[string]int) error {
+		return rebuildHashes(s, entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &HashIndex{s: s, index: index}, nil
+}
+
+func rebuildHashes(s *Storage, entries map[string]int) error {
+	return s.IterItems(func(idx int, r io.Reader) error {
+		if r.(*itemReader).meta != nil {
+			return nil
+		}
+		h := sha256.New()
+		_, err := io.Copy(h, r)
+		if err != nil {
+			return err
+		}
+		entries[hex.EncodeToString(h.Sum(nil))] = idx
+		return nil
+	})
+}
+
+// Find returns the index of a stored item holding exactly the same data.
+// The item is read and compared since the indexed one may have been
+// deleted or its chunks may have been reused since then. Every successful
+// lookup is counted as a dedup hit
+func (hi *HashIndex) Find(data []byte) (int, bool) {
+	idx, found := hi.index.get(dataHash(data))
+	if !found {
+		return 0, false
+	}
+
+	ir, err := hi.s.openItem(idx)
+	if err != nil {
+		return 0, false
+	}
+	defer ir.Close()
+	if ir.meta != nil {
+		return 0, false
+	}
+	stored, err := ioutil.ReadAll(ir)
+	if err != nil || !bytes.Equal(stored, data) {
+		return 0, false
+	}
+
+	atomic.AddInt64(&hi.hits, 1)
+	atomic.AddInt64(&hi.savedBytes, int64(len(data)))
+	return idx, true
+}
+
+// Add indexes data of the item stored at idx
+func (hi *HashIndex) Add(data []byte, idx int) error {
+	_, _, err := hi.index.set(dataHash(data), idx)
+	return err
+}
+
+// Hits returns the number of writes avoided since the index was opened
+func (hi *HashIndex) Hits() int64 {
+	return atomic.LoadInt64(&hi.hits)
+}
+
+// SavedBytes returns the amount of data which hasn't been written
+// thanks to dedup hits since the index was opened
+func (hi *HashIndex) SavedBytes() int64 {
+	return atomic.LoadInt64(&hi.savedBytes)
+}
+
+// Close closes the index file
+func (hi *HashIndex) Close() error {
+	return hi.index.close()
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultDictSize is the default size of a trained dictionary
+	DefaultDictSize = 64 * 1024
+	// dictSampleRatio is how much sample data is collected per dictionary byte
+	dictSampleRatio = 100
+)
+
+var errEnoughSamples = errors.New("enough samples collected")
+
+// dictCodec is zstd compressing with a trained dictionary. The dictionary
+// belongs to a particular storage so the codec is not registered globally
+type dictCodec struct {
+	id   uint32
+	dict []byte
+	pool *zstdPool
+}
+
+func newDictCodec(id uint32, d []byte) *dictCodec {
+	return &dictCodec{
+		id:   id,
+		dict: d,
+		pool: newZstdPool([]zstd.EOption{zstd.WithEncoderDict(d)}, []zstd.DOption{zstd.WithDecoderDicts(d)}),
+	}
+}
+
+func (dc *dictCodec) ID() uint8    { return CodecZstdDict }
+func (dc *dictCodec) Name() string { return "zstd-dict" }
+
+func (dc *dictCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return dc.pool.newWriter(w)
+}
+
+func (dc *dictCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return dc.pool.newReader(r)
+}
+
+// codecByID returns a codec able to read chunks with a given codec ID
+func (s *Storage) codecByID(id uint8) (Codec, error) {
+	if id == CodecZstdDict {
+		if s.dict == nil {
+			return nil, fmt.Errorf("item is compressed with dictionary %08x which is not loaded", s.header.DictID)
+		}
+		return s.dict, nil
+	}
+	return codecByID(id)
+}
+
+// dictionaryID returns the ID of a zstd dictionary
+func dictionaryID(d []byte) (uint32, error) {
+	info, err := zstd.InspectDictionary(d)
+	if err != nil {
+		return 0, err
+	}
+	return info.ID(), nil
+}
+
+// SetDictionary loads the compression dictionary trained for the storage.
+// Once loaded, items fitting into a single chunk are compressed with it
+func (s *Storage) SetDictionary(d []byte) error {
+	id, err := dictionaryID(d)
+	if err != nil {
+		return fmt.Errorf("error loading dictionary: %s", err)
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.header.DictID == 0 {
+		return fmt.Errorf("storage has no dictionary assigned")
+	}
+	if id != s.header.DictID {
+		return fmt.Errorf("dictionary id mismatch: storage uses %08x, got %08x", s.header.DictID, id)
+	}
+	s.dict = newDictCodec(id, d)
+	return nil
+}
+
+// DictionaryID returns the ID of the dictionary assigned to the storage
+// or zero if there's none
+func (s *Storage) DictionaryID() uint32 {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.header.DictID
+}
+
+// TrainDictionary builds a compression dictionary of up to size bytes
+// sampling items which fit into a single chunk. The dictionary is not
+// used until it's assigned with AssignDictionary
+func (s *Storage) TrainDictionary(size int) ([]byte, error) {
+	samples := make([][]byte, 0)
+	sampled := 0
+	limit := s.GetChunkDataSize()
+	err := s.Iter(func(idx int, data []byte) error {
+		if len(data) > limit {
+			return nil
+		}
+		samples = append(samples, data)
+		sampled += len(data)
+		if sampled >= size*dictSampleRatio {
+			return errEnoughSamples
+		}
+		return nil
+	})
+	if err != nil && err != errEnoughSamples {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("storage has no items small enough to train a dictionary")
+	}
+	log.Debugf("training dictionary on %d items (%d bytes)", len(samples), sampled)
+
+	d, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: size, HashBytes: 6})
+	if err != nil {
+		return nil, fmt.Errorf("error building dictionary: %s", err)
+	}
+	return d, nil
+}
+
+// AssignDictionary stores the dictionary id in the storage header and
+// loads the dictionary. A storage may be assigned a dictionary only once
+// since items compressed with it can't be read without it
+func (s *Storage) AssignDictionary(d []byte) error {
+	id, err := dictionaryID(d)
+	if err != nil {
+		return fmt.Errorf("error loading dictionary: %s", err)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.header.Version < slotVersion {
+		return fmt.Errorf("storage version %d has no room for dictionary id, upgrade it first", s.header.Version)
+	}
+	if s.header.DictID != 0 {
+		return fmt.Errorf("storage already has dictionary %08x", s.header.DictID)
+	}
+
+	s.header.DictID = id
+	err = s.writeHeader()
+	if err != nil {
+		s.header.DictID = 0
+		return fmt.Errorf("error writing storage header: %s", err)
+	}
+	s.dict = newDictCodec(id, d)
+	return nil
+}
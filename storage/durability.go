@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Durability represents a guarantee given to a write once it's acknowledged
+type Durability int
+
+// Durability modes
+const (
+	// DurabilityNone leaves flushing data to the OS
+	DurabilityNone Durability = iota
+	// DurabilityAlways syncs the backend after every write
+	DurabilityAlways
+	// DurabilityGroup syncs the backend once for all the writes
+	// committed within a time window
+	DurabilityGroup
+)
+
+// Syncer is an optional interface of a backend able to flush
+// written data to stable storage (e.g. *os.File)
+type Syncer interface {
+	Sync() error
+}
+
+// ParseDurability converts a durability mode name to Durability
+func ParseDurability(name string) (Durability, error) {
+	switch name {
+	case "", "none":
+		return DurabilityNone, nil
+	case "always":
+		return DurabilityAlways, nil
+	case "group":
+		return DurabilityGroup, nil
+	}
+	return DurabilityNone, fmt.Errorf("invalid durability mode '%s'", name)
+}
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityAlways:
+		return "always"
+	case DurabilityGroup:
+		return "group"
+	}
+	return "none"
+}
+
+type syncBatch struct {
+	done chan struct{}
+	err  error
+}
+
+// groupSyncer makes concurrent writers share a single Sync() call.
+// The first writer of a batch opens a time window, everyone coming
+// within the window waits for the same sync
+type groupSyncer struct {
+	syncer  Syncer
+	window  time.Duration
+	lock    sync.Mutex
+	pending *syncBatch
+}
+
+func (g *groupSyncer) sync() error {
+	g.lock.Lock()
+	b := g.pending
+	if b == nil {
+		b = &syncBatch{done: make(chan struct{})}
+		g.pending = b
+		time.AfterFunc(g.window, func() { g.flush(b) })
+	}
+	g.lock.Unlock()
+
+	<-b.done
+	return b.err
+}
+
+func (g *groupSyncer) flush(b *syncBatch) {
+	// writers coming after this point may have written their data
+	// after the sync started so they must wait for the next batch
+	g.lock.Lock()
+	g.pending = nil
+	g.lock.Unlock()
+
+	b.err = g.syncer.Sync()
+	close(b.done)
+}
+
+// SetDurability configures how writes are flushed to stable storage.
+// window is only used in group mode
+func (s *Storage) SetDurability(mode Durability, window time.Duration) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.durability = mode
+	s.group = nil
+	if mode == DurabilityGroup {
+		if syncer, ok := s.backend.(Syncer); ok {
+			s.group = &groupSyncer{syncer: syncer, window: window}
+		}
+	}
+}
+
+// Durability returns the guarantee actually provided for writes which
+// is DurabilityNone when the backend can't be synced
+func (s *Storage) Durability() Durability {
+	if _, ok := s.backend.(Syncer); !ok {
+		return DurabilityNone
+	}
+	return s.durability
+}
+
+// sync flushes committed writes according to the durability mode.
+// Must be called without holding the storage lock so group mode
+// can gather concurrent writers
+func (s *Storage) sync() error {
+	syncer, ok := s.backend.(Syncer)
+	if !ok {
+		return nil
+	}
+
+	switch s.durability {
+	case DurabilityAlways:
+		return syncer.Sync()
+	case DurabilityGroup:
+		return s.group.sync()
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/viert/bookstore/common"
+)
+
+const (
+	// unknownExpiry means the earliest expiration time of items isn't
+	// known yet so the reaper has to scan the storage
+	unknownExpiry uint32 = 0
+	// noExpiry means there are no items to expire
+	noExpiry uint32 = math.MaxUint32
+)
+
+// isExpired checks the expiration time of an item as kept in its
+// first chunk header, zero means the item never expires
+func isExpired(expiresAt uint32, now time.Time) bool {
+	return expiresAt != 0 && int64(expiresAt) <= now.Unix()
+}
+
+func errExpired(idx int) error {
+	return common.NewHTTPError(404, "item %d has expired", idx)
+}
+
+// openLiveItem opens an item like openItem does reporting
+// expired items as not found
+func (s *Storage) openLiveItem(idx int) (*itemReader, error) {
+	ir, err := s.openItem(idx)
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(ir.chain.head.ExpiresAt, time.Now()) {
+		ir.Close()
+		return nil, errExpired(idx)
+	}
+	return ir, nil
+}
+
+// chainLength returns the number of chunks of an item walking chunk
+// headers only. header is the first chunk header of the item
+func (s *Storage) chainLength(header *chunkHeader) (int, error) {
+	length := 1
+	for next := int(header.Next); next >= 0; next = int(header.Next) {
+		var err error
+		header, _, err = s.readVisibleChunkHeader(next)
+		if err != nil {
+			return 0, err
+		}
+		length++
+	}
+	return length, nil
+}
+
+// startsItem reports if a chunk met by a storage walker is the first
+// chunk of a live item
+func (s *Storage) startsItem(header *chunkHeader) bool {
+	return !header.isDeleted() && (s.header.Version < headVersion || header.isHead())
+}
+
+// itemSpan returns the number of chunks a storage walker skips after an
+// item. Since headVersion chains of item writers may interleave with other
+// items so walkers step chunk by chunk looking for first chunks, chains
+// of older storages are contiguous and skipped at once
+func (s *Storage) itemSpan(header *chunkHeader) (int, error) {
+	if s.header.Version >= headVersion {
+		return 1, nil
+	}
+	return s.chainLength(header)
+}
+
+// lowerExpiry lowers an expiration time kept at addr to expiresAt
+// unless it's unknown
+func lowerExpiry(addr *uint32, expiresAt uint32) {
+	for {
+		curr := atomic.LoadUint32(addr)
+		if curr == unknownExpiry || curr <= expiresAt {
+			return
+		}
+		if atomic.CompareAndSwapUint32(addr, curr, expiresAt) {
+			return
+		}
+	}
+}
+
+// noteExpiry lets the reaper know an item expiring at expiresAt is being
+// written. It's noted before the item becomes visible so notes are
+// collected separately until the reaper has scanned the storage
+func (s *Storage) noteExpiry(expiresAt uint32) {
+	if expiresAt == 0 {
+		return
+	}
+	lowerExpiry(&s.notedExpiry, expiresAt)
+	lowerExpiry(&s.nextExpiry, expiresAt)
+}
+
+// ReapExpired deletes all the expired items so their chunks can be reused.
+// callback is called for every item deleted like Delete does. Returns the
+// number of items deleted. The earliest expiration time of the items left
+// is kept so the storage isn't scanned again until it comes
+func (s *Storage) ReapExpired(callback ReplicationCallback) (int, error) {
+	next := atomic.LoadUint32(&s.nextExpiry)
+	if next != unknownExpiry && int64(next) > time.Now().Unix() {
+		return 0, nil
+	}
+	// items noted before the scan may become visible after it has passed
+	// them so their notes are kept along with the items found
+	noted := atomic.SwapUint32(&s.notedExpiry, noExpiry)
+
+	count, earliest, err := s.reapExpired(callback)
+	if err != nil {
+		atomic.StoreUint32(&s.nextExpiry, unknownExpiry)
+		return count, err
+	}
+	if noted < earliest {
+		earliest = noted
+	}
+	atomic.StoreUint32(&s.nextExpiry, earliest)
+	// notes made meanwhile
+	lowerExpiry(&s.nextExpiry, atomic.LoadUint32(&s.notedExpiry))
+
+	if count > 0 {
+		err := s.sync()
+		if err != nil {
+			log.Errorf("error syncing storage: %s", err)
+			return count, common.NewHTTPError(500, "error syncing storage: %s", err)
+		}
+	}
+	return count, nil
+}
+
+// reapExpired deletes expired items returning their number along with
+// the earliest expiration time of the items left
+func (s *Storage) reapExpired(callback ReplicationCallback) (int, uint32, error) {
+	count := 0
+	earliest := noExpiry
+	idx := 0
+	for idx < s.highWaterMark() {
+		header, _, err := s.readVisibleChunkHeader(idx)
+		if err != nil {
+			return count, 0, err
+		}
+		if !s.startsItem(header) {
+			idx++
+			continue
+		}
+
+		span, err := s.itemSpan(header)
+		if err != nil {
+			return count, 0, err
+		}
+		if isExpired(header.ExpiresAt, time.Now()) {
+			err = s.deleteItem(idx, true, callback)
+			if err == nil {
+				count++
+			} else if herr, ok := err.(common.HTTPError); !ok || (herr.Code != 409 && herr.Code != 410) {
+				return count, 0, err
+			}
+			// otherwise the item has been deleted (and maybe
+			// its chunks reused) meanwhile
+		} else if header.ExpiresAt != 0 && header.ExpiresAt < earliest {
+			earliest = header.ExpiresAt
+		}
+		idx += span
+	}
+	return count, earliest, nil
+}
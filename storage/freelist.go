@@ -0,0 +1,83 @@
+package storage
+
+// freeExtent is a run of contiguous free chunks
+type freeExtent struct {
+	start int
+	count int
+}
+
+// freeList holds extents of deleted chunks available for reuse.
+// Extents are kept sorted by their starting index and adjacent
+// extents are always merged together.
+type freeList struct {
+	extents []freeExtent
+}
+
+// add puts count chunks starting at start to the list
+func (fl *freeList) add(start int, count int) {
+	i := 0
+	for i < len(fl.extents) && fl.extents[i].start < start {
+		i++
+	}
+	fl.extents = append(fl.extents, freeExtent{})
+	copy(fl.extents[i+1:], fl.extents[i:])
+	fl.extents[i] = freeExtent{start: start, count: count}
+
+	// merging with the next extent
+	if i+1 < len(fl.extents) && fl.extents[i].start+fl.extents[i].count >= fl.extents[i+1].start {
+		end := fl.extents[i+1].start + fl.extents[i+1].count
+		if end > start+count {
+			fl.extents[i].count = end - start
+		}
+		fl.extents = append(fl.extents[:i+1], fl.extents[i+2:]...)
+	}
+
+	// merging with the previous extent
+	if i > 0 && fl.extents[i-1].start+fl.extents[i-1].count >= fl.extents[i].start {
+		end := fl.extents[i].start + fl.extents[i].count
+		if end > fl.extents[i-1].start+fl.extents[i-1].count {
+			fl.extents[i-1].count = end - fl.extents[i-1].start
+		}
+		fl.extents = append(fl.extents[:i], fl.extents[i+1:]...)
+	}
+}
+
+// find returns the start of the first extent able to hold
+// count chunks or -1 if there's no such extent
+func (fl *freeList) find(count int) int {
+	for _, ext := range fl.extents {
+		if ext.count >= count {
+			return ext.start
+		}
+	}
+	return -1
+}
+
+// claim removes chunks [start, start+count) from the list
+func (fl *freeList) claim(start int, count int) {
+	end := start + count
+	result := fl.extents[:0:0]
+	for _, ext := range fl.extents {
+		extEnd := ext.start + ext.count
+		if extEnd <= start || ext.start >= end {
+			result = append(result, ext)
+			continue
+		}
+		if ext.start < start {
+			result = append(result, freeExtent{start: ext.start, count: start - ext.start})
+		}
+		if extEnd > end {
+			result = append(result, freeExtent{start: end, count: extEnd - end})
+		}
+	}
+	fl.extents = result
+}
+
+// size returns the total number of free chunks in the list
+func (fl *freeList) size() int {
+	total := 0
+	for _, ext := range fl.extents {
+		total += ext.count
+	}
+	return total
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/viert/bookstore/common"
+)
+
+// growBufferChunks is how many empty chunks are written at once on grow
+const growBufferChunks = 256
+
+// GrowCallback is called by Grow with the new number of chunks before
+// the storage is grown locally so a replica is never smaller than master
+type GrowCallback func(numChunks int) error
+
+// NopGrowCallback is a grow callback doing nothing
+func NopGrowCallback(numChunks int) error {
+	return nil
+}
+
+// Grow appends empty chunks to the storage so it has numChunks chunks.
+// Existing data is left intact. Growing to the current size does nothing
+// but still calls the callback so a replica may catch up. Segmented
+// storages are grown by whole segments
+func (s *Storage) Grow(numChunks int, callback GrowCallback) error {
+	err := s.grow(numChunks, callback)
+	if err != nil {
+		log.Errorf("error growing storage: %s", err)
+		return err
+	}
+
+	err = s.sync()
+	if err != nil {
+		log.Errorf("error syncing storage: %s", err)
+		return common.NewHTTPError(500, "error syncing storage: %s", err)
+	}
+	return nil
+}
+
+func (s *Storage) grow(numChunks int, callback GrowCallback) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	current := s.GetNumChunks()
+	if numChunks < current {
+		return common.NewHTTPError(400, "can't shrink storage from %d to %d chunks", current, numChunks)
+	}
+	maxNumChunks := MaxNumChunks
+	if s.header.segmented() {
+		maxNumChunks = MaxSegmentedNumChunks
+	}
+	if numChunks > maxNumChunks {
+		return common.NewHTTPError(400, "number of chunks %d exceeds the maximum of %d", numChunks, maxNumChunks)
+	}
+
+	if callback != nil {
+		err := callback(numChunks)
+		if err != nil {
+			return common.NewHTTPError(500, "replication error: %s", err)
+		}
+	}
+
+	if numChunks == current {
+		return nil
+	}
+
+	if s.header.segmented() {
+		s.locker.Lock()
+		defer s.locker.Unlock()
+		return s.addSegments(numChunks)
+	}
+
+	// new chunks lie beyond NumChunks so they're invisible to readers
+	// until the header is updated, no need to hold the storage lock
+	var chunk bytes.Buffer
+	binary.Write(&chunk, binaryLayout, &chunkHeader{Next: -1})
+	chunk.Write(make([]byte, s.GetChunkDataSize()))
+
+	batch := growBufferChunks
+	if numChunks-current < batch {
+		batch = numChunks - current
+	}
+	buf := bytes.Repeat(chunk.Bytes(), batch)
+
+	pos := int64(s.header.dataOffset() + current*int(s.header.ChunkSize))
+	for idx := current; idx < numChunks; idx += batch {
+		if numChunks-idx < batch {
+			buf = buf[:(numChunks-idx)*int(s.header.ChunkSize)]
+		}
+		n, err := s.backend.WriteAt(buf, pos)
+		if err != nil {
+			return common.NewHTTPError(500, "error writing empty chunks: %s", err)
+		}
+		pos += int64(n)
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.header.NumChunks = int32(numChunks)
+	err := s.writeHeader()
+	if err != nil {
+		s.header.NumChunks = int32(current)
+		return common.NewHTTPError(500, "error writing storage header: %s", err)
+	}
+	log.Infof("storage grown from %d to %d chunks", current, numChunks)
+	return nil
+}
+
+// addSegments adds as many segments as needed for the storage to have
+// at least numChunks chunks. Chunks of new segments are left zeroed,
+// they're never read before being written. Must be called with both
+// locks held
+func (s *Storage) addSegments(numChunks int) error {
+	current := int(s.header.NumChunks)
+	segmentChunks := int(s.header.SegmentChunks)
+	segments := (numChunks - current + segmentChunks - 1) / segmentChunks
+	if segments <= 0 {
+		return nil
+	}
+	if int64(current)+int64(segments*segmentChunks) > MaxSegmentedNumChunks {
+		return fmt.Errorf("storage is full")
+	}
+
+	// writing the last chunk header makes the backend create segment files
+	var chunk bytes.Buffer
+	binary.Write(&chunk, binaryLayout, &chunkHeader{Next: -1})
+	last := current + segments*segmentChunks - 1
+	_, err := s.backend.WriteAt(chunk.Bytes(), s.header.chunkOffset(last))
+	if err != nil {
+		return common.NewHTTPError(500, "error creating segment: %s", err)
+	}
+
+	s.header.NumChunks = int32(current + segments*segmentChunks)
+	err = s.writeHeader()
+	if err != nil {
+		s.header.NumChunks = int32(current)
+		return common.NewHTTPError(500, "error writing storage header: %s", err)
+	}
+	log.Infof("%d segment(s) added, storage has %d chunks", segments, s.header.NumChunks)
+	return nil
+}
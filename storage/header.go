@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+func encodeHeader(h *storeHeader) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binaryLayout, h)
+	data := buf.Bytes()
+	checksum := crc32.Checksum(data[:storeHeaderSize-4], crcTable)
+	binaryLayout.PutUint32(data[storeHeaderSize-4:], checksum)
+	return data
+}
+
+func encodeLegacyHeader(h *storeHeader) []byte {
+	var buf bytes.Buffer
+	lh := legacyHeader{
+		StorageID:    h.StorageID,
+		Version:      h.Version,
+		ChunkSize:    h.ChunkSize,
+		NumChunks:    h.NumChunks,
+		FreeChunkIdx: h.FreeChunkIdx,
+	}
+	binary.Write(&buf, binaryLayout, &lh)
+	return buf.Bytes()
+}
+
+func readHeaderSlot(backend Backend, slot int) (*storeHeader, bool, error) {
+	var header storeHeader
+	p := make([]byte, storeHeaderSize)
+	_, err := backend.ReadAt(p, int64(slot*storeHeaderSize))
+	if err != nil {
+		return nil, false, err
+	}
+	err = binary.Read(bytes.NewBuffer(p), binaryLayout, &header)
+	if err != nil {
+		return nil, false, err
+	}
+	checksum := crc32.Checksum(p[:storeHeaderSize-4], crcTable)
+	valid := checksum == header.Checksum && header.Version >= slotVersion
+	return &header, valid, nil
+}
+
+// saneGeometry checks if header fields which are never changed by
+// regular writes look reasonable
+func (h *storeHeader) saneGeometry() bool {
+	return h.Version >= slotVersion && h.Version <= storageVersion &&
+		int(h.ChunkSize) >= MinChunkSize+chunkHeaderSize &&
+		int(h.ChunkSize) <= MaxChunkSize+chunkHeaderSize &&
+		h.NumChunks > 0
+}
+
+// readStoreHeader reads the storage header. For slotted storages the newest
+// valid slot is chosen. If both slots are damaged, the most plausible one is
+// returned with valid set to false so the caller can recover the rest
+func readStoreHeader(backend Backend) (header *storeHeader, valid bool, err error) {
+	var lh legacyHeader
+	p := make([]byte, legacyHeaderSize)
+	_, err = backend.ReadAt(p, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	err = binary.Read(bytes.NewBuffer(p), binaryLayout, &lh)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if lh.Version > 0 && lh.Version < slotVersion {
+		header = &storeHeader{
+			StorageID:    lh.StorageID,
+			Version:      lh.Version,
+			ChunkSize:    lh.ChunkSize,
+			NumChunks:    lh.NumChunks,
+			FreeChunkIdx: lh.FreeChunkIdx,
+		}
+		return header, true, nil
+	}
+
+	var fallback *storeHeader
+	for slot := 0; slot < headerSlotCount; slot++ {
+		h, ok, err := readHeaderSlot(backend, slot)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			if header == nil || h.Seq > header.Seq {
+				header = h
+			}
+		} else if h.saneGeometry() {
+			if fallback == nil || h.Seq > fallback.Seq {
+				fallback = h
+			}
+		}
+	}
+
+	if header != nil {
+		return header, true, nil
+	}
+	if fallback != nil {
+		return fallback, false, nil
+	}
+	return nil, false, fmt.Errorf("no valid storage header found")
+}
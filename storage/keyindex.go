@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"io"
+)
+
+// KeyIndex maps application keys to indexes of items stored under them.
+// Keys are also saved in item metadata so a lost index file can be
+// rebuilt from the storage
+type KeyIndex struct {
+	index *sidecarIndex
+}
+
+// OpenKeyIndex opens the key index file of a storage. If the file
+// doesn't exist it's rebuilt from metadata of the storage items
+func OpenKeyIndex(filename string, s *Storage) (*KeyIndex, error) {
+	index, err := openSidecarIndex(filename, func(entries map[string]int) error {
+		return rebuildKeys(s, entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeyIndex{index: index}, nil
+}
+
+// rebuildKeys collects keys from metadata of all the items. Normally only
+// one item has a key, if there are more of them (i.e. replacing of
+// an item has been interrupted) the most recent one wins
+func rebuildKeys(s *Storage, entries map[string]int) error {
+	created := make(map[string]*ItemMeta)
+	return s.IterItems(func(idx int, r io.Reader) error {
+		meta := r.(*itemReader).meta
+		if meta == nil || meta.Key == "" {
+			return nil
+		}
+		if prev, found := created[meta.Key]; found && prev.Created.After(meta.Created) {
+			return nil
+		}
+		created[meta.Key] = meta
+		entries[meta.Key] = idx
+		return nil
+	})
+}
+
+// Get returns the index of the item stored under key
+func (ki *KeyIndex) Get(key string) (int, bool) {
+	return ki.index.get(key)
+}
+
+// Set binds key to the item at idx. The index of the item previously
+// stored under the key is returned so the caller may delete it
+func (ki *KeyIndex) Set(key string, idx int) (int, bool, error) {
+	return ki.index.set(key, idx)
+}
+
+// Len returns the number of keys in the index
+func (ki *KeyIndex) Len() int {
+	return ki.index.len()
+}
+
+// Close closes the index file
+func (ki *KeyIndex) Close() error {
+	return ki.index.close()
+}
@@ -1,10 +1,13 @@
 package storage
 
+import "sync"
+
 // MemBackend represents an in-memory backend for storage
 // mostly for testing purposes
 type MemBackend struct {
 	data []byte
 	idx  int
+	lock sync.RWMutex
 }
 
 func NewMemBackend() *MemBackend {
@@ -15,6 +18,8 @@ func NewMemBackend() *MemBackend {
 }
 
 func (mb *MemBackend) WriteAt(p []byte, off int64) (int, error) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
 	off32 := int(off) // sure it won't overflow
 	appendLen := off32 + len(p) - len(mb.data)
 	if appendLen > 0 {
@@ -25,6 +30,8 @@ func (mb *MemBackend) WriteAt(p []byte, off int64) (int, error) {
 }
 
 func (mb *MemBackend) ReadAt(p []byte, off int64) (int, error) {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
 	off32 := int(off) // sure it won't overflow
 	readLen := len(mb.data) - off32
 	if len(p) > readLen {
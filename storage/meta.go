@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/viert/bookstore/common"
+)
+
+// MaxMetaSize is the maximum size of an encoded metadata record
+const MaxMetaSize = 4096
+
+// ItemMeta is a metadata record stored along with item data.
+// Length and Codec are filled in by the storage on write,
+// Created is set to the current time unless it's given. Key is
+// the application key the item is stored under if any. Expires is
+// the time the item expires at, it's kept in the chunk header as well
+type ItemMeta struct {
+	Created     time.Time         `json:"created"`
+	Expires     *time.Time        `json:"expires,omitempty"`
+	Key         string            `json:"key,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Length      int               `json:"length"`
+	Codec       string            `json:"codec"`
+	Attrs       map[string]string `json:"attrs,omitempty"`
+}
+
+// expiresAt returns the expiration time as stored in the chunk header
+func (m *ItemMeta) expiresAt() (uint32, error) {
+	if m.Expires == nil {
+		return 0, nil
+	}
+	t := m.Expires.Unix()
+	if t <= 0 || t > math.MaxUint32 {
+		return 0, common.NewHTTPError(400, "invalid expiration time %s", m.Expires)
+	}
+	return uint32(t), nil
+}
+
+// encodeMeta returns a metadata record prefixed with its length
+func encodeMeta(meta *ItemMeta) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxMetaSize {
+		return nil, common.NewHTTPError(400, "metadata is too large: %d bytes, max is %d", len(data), MaxMetaSize)
+	}
+	buf := make([]byte, 4+len(data))
+	binaryLayout.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	return buf, nil
+}
+
+// readMeta reads a metadata record from the beginning of raw item data
+func readMeta(r io.Reader) (*ItemMeta, error) {
+	var size uint32
+	err := binary.Read(r, binaryLayout, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxMetaSize {
+		return nil, fmt.Errorf("invalid metadata size %d", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	meta := new(ItemMeta)
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// metaRecord completes meta with the data length and codec
+// and returns the encoded record
+func (s *Storage) metaRecord(meta *ItemMeta, length int, codec uint8) ([]byte, error) {
+	m := *meta
+	m.Length = length
+	m.Codec = "none"
+	if c, err := s.codecByID(codec); err == nil {
+		m.Codec = c.Name()
+	}
+	if m.Created.IsZero() {
+		m.Created = time.Now().UTC()
+	}
+	return encodeMeta(&m)
+}
+
+// OpenItemMeta returns a reader of the item starting at idx along with
+// its metadata. Metadata is nil for items written without it
+func (s *Storage) OpenItemMeta(idx int) (io.ReadCloser, *ItemMeta, error) {
+	log.Debugf("opening item %d", idx)
+	return s.openCached(idx)
+}
+
+// ReadMeta returns metadata of the item starting at idx
+func (s *Storage) ReadMeta(idx int) (*ItemMeta, error) {
+	rd, meta, err := s.openCached(idx)
+	if err != nil {
+		return nil, err
+	}
+	rd.Close()
+	return meta, nil
+}
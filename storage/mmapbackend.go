@@ -0,0 +1,130 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// MmapBackend is a file backend serving reads from a shared read-only
+// memory mapping of the file. Writes go to the file itself and become
+// visible through the mapping via the page cache. When a read goes past
+// the mapped area the file is mapped again; previous mappings are kept
+// until Close so slices returned by Slice never become invalid
+type MmapBackend struct {
+	file *os.File
+	lock sync.RWMutex
+	data []byte
+	old  [][]byte
+}
+
+// NewMmapBackend maps a file opened for reading and writing
+func NewMmapBackend(f *os.File) (*MmapBackend, error) {
+	mb := &MmapBackend{file: f}
+	err := mb.remap(0)
+	if err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// remap maps the file again if it's grown enough to hold end bytes
+func (mb *MmapBackend) remap(end int64) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if end > 0 && end <= int64(len(mb.data)) {
+		// somebody else has already remapped the file
+		return nil
+	}
+
+	st, err := mb.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	if size <= int64(len(mb.data)) || size == 0 {
+		return nil
+	}
+
+	data, err := syscall.Mmap(int(mb.file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if mb.data != nil {
+		mb.old = append(mb.old, mb.data)
+	}
+	mb.data = data
+	return nil
+}
+
+// Slice returns n bytes at off as a slice of the mapping. The slice must
+// not be modified, its contents reflect subsequent writes
+func (mb *MmapBackend) Slice(off int64, n int) ([]byte, error) {
+	end := off + int64(n)
+	mb.lock.RLock()
+	if end <= int64(len(mb.data)) {
+		p := mb.data[off:end:end]
+		mb.lock.RUnlock()
+		return p, nil
+	}
+	mb.lock.RUnlock()
+
+	err := mb.remap(end)
+	if err != nil {
+		return nil, err
+	}
+
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	if end > int64(len(mb.data)) {
+		return nil, io.EOF
+	}
+	return mb.data[off:end:end], nil
+}
+
+// ReadAt implements io.ReaderAt copying data from the mapping
+func (mb *MmapBackend) ReadAt(p []byte, off int64) (int, error) {
+	data, err := mb.Slice(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, data), nil
+}
+
+// WriteAt implements io.WriterAt
+func (mb *MmapBackend) WriteAt(p []byte, off int64) (int, error) {
+	return mb.file.WriteAt(p, off)
+}
+
+func (mb *MmapBackend) Write(p []byte) (int, error) {
+	return mb.file.Write(p)
+}
+
+// Sync flushes the file to stable storage
+func (mb *MmapBackend) Sync() error {
+	return mb.file.Sync()
+}
+
+// Close unmaps the file. The file itself is left open
+func (mb *MmapBackend) Close() error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	var err error
+	for _, data := range append(mb.old, mb.data) {
+		if data == nil {
+			continue
+		}
+		if uerr := syscall.Munmap(data); uerr != nil {
+			err = uerr
+		}
+	}
+	mb.data = nil
+	mb.old = nil
+	return err
+}
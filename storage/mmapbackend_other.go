@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// MmapBackend is not supported on this platform
+type MmapBackend struct {
+	*os.File
+}
+
+// NewMmapBackend always fails on this platform
+func NewMmapBackend(f *os.File) (*MmapBackend, error) {
+	return nil, fmt.Errorf("mmap backend is not supported on this platform")
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// MetaIterationCallback is called with metadata and a reader of every
+// item when using ParallelIterItems() method. Metadata is nil for items
+// written without it
+type MetaIterationCallback func(idx int, meta *ItemMeta, r io.Reader) error
+
+// iterJob is an item found by ParallelIter. In ordered mode the data
+// is passed back to the delivering goroutine through result. skip is
+// set if the item has been deleted before it's read, large is set for
+// items taking more than a chunk
+type iterJob struct {
+	idx    int
+	large  bool
+	data   []byte
+	meta   *ItemMeta
+	err    error
+	skip   bool
+	result chan *iterJob
+}
+
+// ParallelIter iterates over items like Iter does but reads and uncompresses
+// them on workers goroutines. Item boundaries are still found sequentially.
+// In unordered mode callback is called concurrently from the workers as
+// items are ready so it must be safe for concurrent use. In ordered mode
+// callback is called from a single goroutine in the order of items.
+// Items deleted before they're read are skipped. The first error stops
+// the iteration and is returned
+func (s *Storage) ParallelIter(workers int, ordered bool, callback IterationCallback) error {
+	return s.parallelIter(workers, ordered, false, func(job *iterJob) error {
+		return callback(job.idx, job.data)
+	})
+}
+
+// ParallelIterItems iterates over items like ParallelIter does passing
+// readers of items to callback. Items fitting into a chunk are read and
+// uncompressed by workers, larger ones are streamed by callback itself like
+// IterItems does, so memory use is bounded by the chunk size no matter how
+// large items are
+func (s *Storage) ParallelIterItems(workers int, ordered bool, callback MetaIterationCallback) error {
+	return s.parallelIter(workers, ordered, true, func(job *iterJob) error {
+		if !job.large {
+			return callback(job.idx, job.meta, bytes.NewReader(job.data))
+		}
+
+		ir, err := s.openItem(job.idx)
+		if isDeleted(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = callback(job.idx, ir.meta, ir)
+		ir.Close()
+		if err != nil && ir.chain.deleted {
+			log.Debugf("item %d has been deleted while iterating, skipping it", job.idx)
+			return nil
+		}
+		return err
+	})
+}
+
+// parallelIter runs the workers calling deliver with every item read.
+// If stream is set large items are left for deliver to read
+func (s *Storage) parallelIter(workers int, ordered bool, stream bool, deliver func(job *iterJob) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		err     error
+		errOnce sync.Once
+		wg      sync.WaitGroup
+	)
+	stop := make(chan struct{})
+	fail := func(e error) {
+		errOnce.Do(func() {
+			err = e
+			close(stop)
+		})
+	}
+
+	jobs := make(chan *iterJob, workers)
+	// delivery keeps jobs in the order they were found, it's used
+	// in ordered mode only
+	delivery := make(chan *iterJob, workers*2)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case <-stop:
+					// jobs left are drained without reading items
+					continue
+				default:
+				}
+				if !stream || !job.large {
+					job.data, job.meta, job.err = s.readItemMeta(job.idx)
+				}
+				if isDeleted(job.err) {
+					job.skip = true
+					job.err = nil
+				}
+				if ordered {
+					job.result <- job
+					continue
+				}
+				if job.err == nil && !job.skip {
+					job.err = deliver(job)
+				}
+				if job.err != nil {
+					fail(job.err)
+				}
+			}
+		}()
+	}
+
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		for job := range delivery {
+			select {
+			case <-stop:
+				continue
+			case <-job.result:
+			}
+			if job.err == nil && !job.skip {
+				job.err = deliver(job)
+			}
+			if job.err != nil {
+				fail(job.err)
+			}
+		}
+	}()
+
+	ferr := s.findItems(stop, func(idx int, header *chunkHeader) {
+		job := &iterJob{idx: idx, large: header.Next >= 0}
+		if ordered {
+			job.result = make(chan *iterJob, 1)
+			select {
+			case delivery <- job:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case jobs <- job:
+		case <-stop:
+		}
+	})
+	if ferr != nil {
+		fail(ferr)
+	}
+
+	close(jobs)
+	close(delivery)
+	wg.Wait()
+	<-delivered
+	return err
+}
+
+// findItems walks first chunks of items calling found with the index and
+// the first chunk header of every item which hasn't expired until the end
+// of storage or until stop is closed
+func (s *Storage) findItems(stop <-chan struct{}, found func(idx int, header *chunkHeader)) error {
+	idx := 0
+	for idx < s.highWaterMark() {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		header, _, err := s.readVisibleChunkHeader(idx)
+		if err != nil {
+			return err
+		}
+		if !s.startsItem(header) {
+			idx++
+			continue
+		}
+
+		if !isExpired(header.ExpiresAt, time.Now()) {
+			found(idx, header)
+		}
+
+		span, err := s.itemSpan(header)
+		if err != nil {
+			return err
+		}
+		idx += span
+	}
+	return nil
+}
+
+func (s *Storage) readItemMeta(idx int) ([]byte, *ItemMeta, error) {
+	ir, err := s.openItem(idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ir.Close()
+	data, err := ioutil.ReadAll(ir)
+	return data, ir.meta, err
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/viert/bookstore/common"
+)
+
+// ItemIterationCallback is called with a reader of every item
+// in storage when using IterItems() method
+type ItemIterationCallback func(idx int, r io.Reader) error
+
+// chainReader reads raw data of an item chunk by chunk following
+// Next links, so only one chunk is kept in memory at a time. deleted
+// is set if the item turns out to be deleted while it's read.
+//
+// Data of backends implementing Slicer isn't copied, it's served right
+// from the mapping. mapped is set then and the chunk being read (curr,
+// header) is checked after every read to be still the one loaded
+type chainReader struct {
+	s       *Storage
+	idx     int
+	head    *chunkHeader
+	header  *chunkHeader
+	curr    int
+	next    int
+	chunks  int
+	size    int
+	raw     []byte
+	plain   []byte
+	buf     []byte
+	pos     int
+	mapped  bool
+	deleted bool
+}
+
+func (s *Storage) newChainReader(idx int) (*chainReader, error) {
+	cr := &chainReader{
+		s:   s,
+		idx: idx,
+	}
+	// the first chunk is read right away so errors like
+	// a missing or deleted item are reported on open
+	err := cr.loadChunk(idx)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// loadChunk reads chunk idx without taking storage locks. A chunk may
+// be rewritten while it's read if its item is being deleted or overwritten,
+// so a checksum mismatch is retried once before reporting corruption
+func (cr *chainReader) loadChunk(idx int) error {
+	err := cr.readChunk(idx)
+	if _, ok := err.(ChecksumError); ok {
+		err = cr.readChunk(idx)
+		if _, ok := err.(ChecksumError); ok {
+			log.Errorf("chunk %d checksum mismatch", idx)
+		}
+	}
+	return err
+}
+
+func (cr *chainReader) readChunk(idx int) error {
+	s := cr.s
+	header, pos, err := s.readVisibleChunkHeader(idx)
+	if err != nil {
+		return err
+	}
+	if header.isDeleted() {
+		cr.deleted = true
+		return errDeleted(cr.idx)
+	}
+	if cr.head != nil && (header.Gen != cr.head.Gen || s.header.Version >= headVersion && header.isHead()) {
+		// the item has been deleted and the chunk reused by another one
+		// since the previous chunk has been read
+		cr.deleted = true
+		return errDeleted(cr.idx)
+	}
+	if header.DataSize < 0 || int(header.DataSize) > s.GetChunkDataSize() {
+		return common.NewHTTPError(500, "chunk %d has invalid data size %d", idx, header.DataSize)
+	}
+
+	cr.raw, err = s.readAt(cr.raw, int(header.DataSize), pos+int64(chunkHeaderSize))
+	if err != nil {
+		return common.NewHTTPError(500, "error reading chunk data: %s", err)
+	}
+	if s.header.Version >= checksumVersion {
+		checksum := crc32.Checksum(cr.raw, crcTable)
+		if checksum != header.Checksum {
+			return ChecksumError{Idx: idx, Expected: header.Checksum, Actual: checksum}
+		}
+	}
+
+	_, slicer := s.backend.(Slicer)
+	cr.mapped = slicer && header.KeyID == 0
+	cr.buf = cr.raw
+	if header.KeyID != 0 {
+		cr.plain, err = s.decryptChunk(cr.plain[:0], idx, header, cr.raw)
+		if err != nil {
+			return common.NewHTTPError(500, "%s", err)
+		}
+		cr.buf = cr.plain
+	}
+
+	if cr.head == nil {
+		cr.head = header
+	}
+	cr.header = header
+	cr.curr = idx
+	cr.next = int(header.Next)
+	cr.pos = 0
+	cr.chunks++
+	cr.size += len(cr.buf)
+	return nil
+}
+
+func (cr *chainReader) Read(p []byte) (int, error) {
+	for cr.pos >= len(cr.buf) {
+		if cr.next < 0 {
+			return 0, io.EOF
+		}
+		err := cr.loadChunk(cr.next)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf[cr.pos:])
+	if cr.mapped {
+		err := cr.checkChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	cr.pos += n
+	return n, nil
+}
+
+// checkChunk makes sure the chunk being read hasn't been rewritten since
+// it's been loaded. A chunk is reused only after its item is deleted and
+// rewritten header first, so data copied out of a mapping before its
+// header is found intact is the data loaded
+func (cr *chainReader) checkChunk() error {
+	header, _, err := cr.s.readVisibleChunkHeader(cr.curr)
+	if err != nil {
+		return err
+	}
+	if *header != *cr.header {
+		cr.deleted = true
+		return errDeleted(cr.idx)
+	}
+	return nil
+}
+
+// itemReader is a chain reader uncompressing data on the fly if needed.
+// size is the uncompressed data size, -1 if the item doesn't keep it
+type itemReader struct {
+	chain *chainReader
+	r     io.Reader
+	zr    io.ReadCloser
+	meta  *ItemMeta
+	size  int64
+}
+
+func (ir *itemReader) Read(p []byte) (int, error) {
+	return ir.r.Read(p)
+}
+
+func (ir *itemReader) Close() error {
+	if ir.zr != nil {
+		return ir.zr.Close()
+	}
+	return nil
+}
+
+func (s *Storage) openItem(idx int) (*itemReader, error) {
+	chain, err := s.newChainReader(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	ir := &itemReader{chain: chain, r: chain}
+	ir.size, err = readSize(chain)
+	if _, ok := err.(ChecksumError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, common.NewHTTPError(500, "error reading size of item %d: %s", idx, err)
+	}
+	if chain.head.Flags&chunkMeta != 0 {
+		ir.meta, err = readMeta(chain)
+		if _, ok := err.(ChecksumError); ok {
+			return nil, err
+		}
+		if err != nil {
+			return nil, common.NewHTTPError(500, "error reading metadata of item %d: %s", idx, err)
+		}
+	}
+	if chain.head.Codec != CodecNone {
+		codec, err := s.codecByID(chain.head.Codec)
+		if err != nil {
+			return nil, common.NewHTTPError(500, "error uncompressing item %d: %s", idx, err)
+		}
+		log.Debugf("uncompressing item %d with %s", idx, codec.Name())
+		ir.zr, err = codec.NewReader(chain)
+		if err != nil {
+			return nil, common.NewHTTPError(500, "error uncompressing item %d: %s", idx, err)
+		}
+		ir.r = ir.zr
+	}
+	return ir, nil
+}
+
+// readSize reads the uncompressed size of an item from the beginning
+// of its chain, -1 is returned for items written without it
+func readSize(chain *chainReader) (int64, error) {
+	if chain.head.Flags&chunkSized == 0 {
+		return -1, nil
+	}
+	var size uint64
+	err := binary.Read(chain, binaryLayout, &size)
+	if err != nil {
+		return -1, err
+	}
+	return int64(size), nil
+}
+
+// OpenItem returns a reader of the item starting at idx. Chunks are read
+// lazily and uncompressed on the fly so memory usage is bounded by the
+// chunk size regardless of the item size
+func (s *Storage) OpenItem(idx int) (io.ReadCloser, error) {
+	log.Debugf("opening item %d", idx)
+	rd, _, err := s.openCached(idx)
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// IterItems iterates over items calling callback with a reader of
+// each item it comes across. Deleted and expired items are skipped.
+// No locks are held so writers aren't blocked however long the iteration
+// takes, items appended meanwhile are iterated over as well. Items deleted
+// (or reaped) after they're found are skipped as well, even if callback
+// has read a part of them already
+func (s *Storage) IterItems(callback ItemIterationCallback) error {
+	idx := 0
+	for idx < s.highWaterMark() {
+		header, _, err := s.readVisibleChunkHeader(idx)
+		if err != nil {
+			return err
+		}
+		if !s.startsItem(header) {
+			idx++
+			continue
+		}
+		span, err := s.itemSpan(header)
+		if err != nil {
+			return err
+		}
+		if isExpired(header.ExpiresAt, time.Now()) {
+			idx += span
+			continue
+		}
+
+		ir, err := s.openItem(idx)
+		if isDeleted(err) {
+			idx++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = callback(idx, ir)
+		ir.Close()
+		if err != nil && ir.chain.deleted {
+			log.Debugf("item %d has been deleted while iterating, skipping it", idx)
+			idx++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		idx += span
+	}
+	return nil
+}
+
+func errDeleted(idx int) error {
+	return common.NewHTTPError(410, "item %d has been deleted", idx)
+}
+
+// isDeleted checks if err reports a deleted item. Iterations hold no
+// locks so items they find may be deleted before they're read, chunks
+// of such items are skipped one by one like other tombstones
+func isDeleted(err error) bool {
+	herr, ok := err.(common.HTTPError)
+	return ok && herr.Code == 410
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"github.com/viert/bookstore/common"
+)
+
+// reservation is a range of chunks reserved by a writer. Chunks of deleted
+// items are reused right away, chunks past FreeChunkIdx are published in
+// the order they were reserved so FreeChunkIdx never skips an unfinished
+// item. Reserved chunks are written and replicated without any lock held
+type reservation struct {
+	start     int
+	count     int
+	reused    bool
+	done      bool
+	failed    bool
+	published bool
+	// stats of the item written, counted when it's completed
+	stats itemStats
+}
+
+// chunkFlags returns flags for chunks written into the reservation.
+// Reused chunks are below the high-water mark so they are written as
+// tombstones and revived on completion
+func (r *reservation) chunkFlags() uint8 {
+	if r.reused {
+		return chunkDeleted
+	}
+	return 0
+}
+
+// chunks returns indices of the reserved chunks
+func (r *reservation) chunks() []int {
+	chunks := make([]int, r.count)
+	for i := range chunks {
+		chunks[i] = r.start + i
+	}
+	return chunks
+}
+
+// reserve reserves count chunks preferring chunks of deleted items.
+// Must be called with both locks held
+func (s *Storage) reserve(count int) (*reservation, error) {
+	if idx := s.free.find(count); idx >= 0 {
+		s.free.claim(idx, count)
+		return &reservation{start: idx, count: count, reused: true}, nil
+	}
+	return s.reserveTail(count)
+}
+
+// reserveTail reserves count chunks at the end of reserved space.
+// Must be called with both locks held
+func (s *Storage) reserveTail(count int) (*reservation, error) {
+	if count > 0 {
+		err := s.ensureChunk(s.tail + count - 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := &reservation{start: s.tail, count: count}
+	s.tail += count
+	s.pending = append(s.pending, r)
+	return r, nil
+}
+
+// reserveHeld reserves count chunks for a writer which may hold them for
+// long (see ItemWriter). Tail chunks are turned into tombstones and
+// published right away so they don't hold back other reservations, from
+// then on they're treated as reused ones. Must be called with both locks held
+func (s *Storage) reserveHeld(count int) (*reservation, error) {
+	r, err := s.reserve(count)
+	if err != nil || r.reused {
+		return r, err
+	}
+	for idx := r.start; err == nil && idx < r.start+count; idx++ {
+		err = s.writeChunkHeader(idx, &chunkHeader{Next: -1, Flags: chunkDeleted})
+	}
+	r.done = true
+	r.failed = err != nil
+	s.publishPending()
+	if err != nil {
+		return nil, common.NewHTTPError(500, "error writing chunk header: %s", err)
+	}
+	r.reused = true
+	return r, nil
+}
+
+// complete finishes reservations after their chunks are written and
+// replicated. If err is not nil or reused chunks can't be revived all the
+// reservations are dropped: reused chunks go back to the free list, the
+// tail is rolled back if possible and left as tombstones otherwise.
+// On success the items are added to statistics and it waits for the
+// reservations to be published. Must be called with locker held
+func (s *Storage) complete(rs []*reservation, err error) error {
+	if err == nil {
+		err = s.revive(rs)
+	}
+
+	// the outcome is the same for all the reservations of a batch
+	for _, r := range rs {
+		if err == nil {
+			s.addStats(r.start, r.stats, 1)
+		}
+		if !r.reused {
+			r.done = true
+			r.failed = err != nil
+		} else if err != nil {
+			s.free.add(r.start, r.count)
+		}
+	}
+
+	published := s.publishPending()
+	if err != nil && !published {
+		return err
+	}
+
+	// statistics and FreeChunkIdx are persisted at once
+	perr := s.writeHeader()
+	if perr != nil {
+		log.Errorf("error writing storage header: %s", perr)
+		perr = common.NewHTTPError(500, "error writing storage header: %s", perr)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rs {
+		for !r.reused && !r.published {
+			s.publishedCond.Wait()
+		}
+	}
+	return perr
+}
+
+// revive clears chunkDeleted flags of reused reservations. If any of
+// them fails the chunks revived so far are deleted again so none of
+// the items becomes visible. Must be called with locker held
+func (s *Storage) revive(rs []*reservation) error {
+	for i, r := range rs {
+		if !r.reused {
+			continue
+		}
+		// first chunks are revived last so readers never meet an item
+		// which is revived partially
+		chunks := r.chunks()
+		for i, j := 0, len(chunks)-1; i < j; i, j = i+1, j-1 {
+			chunks[i], chunks[j] = chunks[j], chunks[i]
+		}
+		err := s.setChainFlags(chunks, chunkDeleted, false)
+		s.invalidateCache(r.start)
+		if err == nil {
+			continue
+		}
+		log.Errorf("error committing chunks: %s", err)
+		for _, prev := range rs[:i+1] {
+			if !prev.reused {
+				continue
+			}
+			derr := s.setChainFlags(prev.chunks(), chunkDeleted, true)
+			if derr != nil {
+				log.Errorf("error deleting chunks of item %d back: %s", prev.start, derr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// publishPending publishes finished tail reservations in order
+// advancing FreeChunkIdx. Returns true if FreeChunkIdx has changed
+// so the header needs to be written. Must be called with locker held
+func (s *Storage) publishPending() bool {
+	// failed reservations at the very end are just forgotten. Their first
+	// chunks are cleared so they aren't taken for written items if the
+	// storage is reopened before the chunks are reused (see skipWrittenChunks)
+	for len(s.pending) > 0 {
+		last := s.pending[len(s.pending)-1]
+		if !last.failed {
+			break
+		}
+		if last.count > 0 {
+			err := s.writeChunkHeader(last.start, &chunkHeader{})
+			if err != nil {
+				log.Errorf("error clearing chunk %d: %s", last.start, err)
+			}
+		}
+		s.tail = last.start
+		s.pending = s.pending[:len(s.pending)-1]
+	}
+
+	freeChunkIdx := int(s.header.FreeChunkIdx)
+	for len(s.pending) > 0 && s.pending[0].done {
+		r := s.pending[0]
+		s.pending = s.pending[1:]
+		if r.failed {
+			s.tombstone(r.start, r.count)
+		}
+		freeChunkIdx = r.start + r.count
+		r.published = true
+	}
+	s.publishedCond.Broadcast()
+	if freeChunkIdx == int(s.header.FreeChunkIdx) {
+		return false
+	}
+
+	s.header.FreeChunkIdx = int32(freeChunkIdx)
+	s.publish()
+	return true
+}
+
+// tombstone marks count chunks starting at start as deleted and puts
+// them to the free list. Must be called with locker held
+func (s *Storage) tombstone(start int, count int) {
+	for idx := start; idx < start+count; idx++ {
+		err := s.writeChunkHeader(idx, &chunkHeader{Next: -1, Flags: chunkDeleted})
+		if err != nil {
+			log.Errorf("error writing tombstone to chunk %d: %s", idx, err)
+			continue
+		}
+		s.free.add(idx, 1)
+	}
+}
+
+// waitPending waits until all the tail reservations are published.
+// Must be called with both locks held
+func (s *Storage) waitPending() {
+	for len(s.pending) > 0 {
+		s.publishedCond.Wait()
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/viert/bookstore/common"
+)
+
+// ScanItem is an item returned by Scan. Data of items larger than
+// the size limit of a scan is left out and Large is set, such items
+// have to be read separately
+type ScanItem struct {
+	Idx   int
+	Meta  *ItemMeta
+	Data  []byte
+	Large bool
+}
+
+// Scan returns up to limit items starting from index from along with
+// a cursor to pass as from to get the next page, -1 means there are no
+// more items. Forward scanning starts from the first item at or after from,
+// reverse scanning starts from the last item at or before from, negative
+// from means the end of storage. Data of items up to maxSize bytes is
+// included so a page takes limit*maxSize bytes of memory at most. Like
+// IterItems it holds no locks and skips expired items as well as items
+// deleted while they're read
+func (s *Storage) Scan(from int, limit int, maxSize int, reverse bool) ([]ScanItem, int, error) {
+	if s.header.Version < headVersion {
+		return nil, -1, common.NewHTTPError(400, "storage version %d doesn't support scanning, upgrade it first", s.header.Version)
+	}
+	if limit <= 0 {
+		return nil, -1, common.NewHTTPError(400, "invalid scan limit %d", limit)
+	}
+	if maxSize < 0 {
+		return nil, -1, common.NewHTTPError(400, "invalid scan item size limit %d", maxSize)
+	}
+	if reverse {
+		return s.scanReverse(from, limit, maxSize)
+	}
+	return s.scanForward(from, limit, maxSize)
+}
+
+func (s *Storage) scanForward(from int, limit int, maxSize int) ([]ScanItem, int, error) {
+	items := make([]ScanItem, 0, limit)
+	idx := from
+	if idx < 0 {
+		idx = 0
+	}
+	for idx < s.highWaterMark() && len(items) < limit {
+		header, _, err := s.readVisibleChunkHeader(idx)
+		if err != nil {
+			return nil, -1, err
+		}
+		if header.isDeleted() || !header.isHead() || isExpired(header.ExpiresAt, time.Now()) {
+			idx++
+			continue
+		}
+
+		var item ScanItem
+		ir, err := s.openItem(idx)
+		if err == nil {
+			item, err = readScanItem(idx, ir, maxSize)
+		}
+		if isDeleted(err) {
+			// deleted after its first chunk has been checked
+			idx++
+			continue
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+		items = append(items, item)
+		idx++
+	}
+
+	if idx >= s.highWaterMark() {
+		idx = -1
+	}
+	return items, idx, nil
+}
+
+func (s *Storage) scanReverse(from int, limit int, maxSize int) ([]ScanItem, int, error) {
+	items := make([]ScanItem, 0, limit)
+	idx := from
+	if hwm := s.highWaterMark(); idx < 0 || idx >= hwm {
+		idx = hwm - 1
+	}
+	for idx >= 0 && len(items) < limit {
+		header, _, err := s.readVisibleChunkHeader(idx)
+		if err != nil {
+			return nil, -1, err
+		}
+		if header.isDeleted() || !header.isHead() || isExpired(header.ExpiresAt, time.Now()) {
+			idx--
+			continue
+		}
+
+		var item ScanItem
+		ir, err := s.openItem(idx)
+		if err == nil {
+			item, err = readScanItem(idx, ir, maxSize)
+		}
+		if isDeleted(err) {
+			// deleted after its first chunk has been checked
+			idx--
+			continue
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+		items = append(items, item)
+		idx--
+	}
+	return items, idx, nil
+}
+
+func readScanItem(idx int, ir *itemReader, maxSize int) (ScanItem, error) {
+	defer ir.Close()
+	item := ScanItem{Idx: idx, Meta: ir.meta}
+	if ir.size > int64(maxSize) {
+		item.Large = true
+		return item, nil
+	}
+	// sizes of items written by older versions aren't known until
+	// they're read, they're read up to the limit
+	data, err := ioutil.ReadAll(io.LimitReader(ir, int64(maxSize)+1))
+	if err != nil {
+		return ScanItem{}, err
+	}
+	if len(data) > maxSize {
+		item.Large = true
+		return item, nil
+	}
+	item.Data = data
+	return item, nil
+}
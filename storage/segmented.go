@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// SegmentedBackend spans a storage over numbered segment files
+// <base>.0000, <base>.0001 and so on, every one holding a fixed number
+// of chunks. Offsets are positions in the concatenation of segments,
+// missing segments are created on write
+type SegmentedBackend struct {
+	base        string
+	segmentSize int64
+	lock        sync.RWMutex
+	files       []*os.File
+	pos         int64
+}
+
+// SegmentFileName returns the name of the n-th segment file
+func SegmentFileName(base string, n int) string {
+	return fmt.Sprintf("%s.%04d", base, n)
+}
+
+// CreateSegmentedStorage creates the first segment of a segmented storage.
+// Further segments are added when the storage runs out of chunks
+func CreateSegmentedStorage(base string, chunkDataSize int, segmentChunks int, storageID uint64) (uint64, error) {
+	if storageID == 0 {
+		storageID = randomStorageID()
+	}
+
+	f, err := os.OpenFile(SegmentFileName(base, 0), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := storeHeader{
+		StorageID:     storageID,
+		Version:       storageVersion,
+		ChunkSize:     int32(chunkDataSize + chunkHeaderSize),
+		NumChunks:     int32(segmentChunks),
+		SegmentChunks: int32(segmentChunks),
+	}
+	err = writeStorage(f, &header)
+	if err != nil {
+		return 0, err
+	}
+	return storageID, f.Sync()
+}
+
+// IsSegmented tells if backend holds the first segment of a segmented
+// storage without opening it
+func IsSegmented(backend Backend) (bool, error) {
+	header, _, err := readStoreHeader(backend)
+	if err != nil {
+		return false, err
+	}
+	return header.segmented(), nil
+}
+
+// OpenSegmentedBackend opens all the existing segment files of a storage
+func OpenSegmentedBackend(base string) (*SegmentedBackend, error) {
+	f, err := os.OpenFile(SegmentFileName(base, 0), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _, err := readStoreHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading storage header: %s", err)
+	}
+	if !header.segmented() {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a segmented storage", f.Name())
+	}
+
+	sb := &SegmentedBackend{
+		base:        base,
+		segmentSize: header.segmentSize(),
+		files:       []*os.File{f},
+	}
+	for n := 1; ; n++ {
+		f, err := os.OpenFile(SegmentFileName(base, n), os.O_RDWR, 0644)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			sb.Close()
+			return nil, err
+		}
+		sb.files = append(sb.files, f)
+	}
+	return sb, nil
+}
+
+// segment returns the n-th segment file creating missing segments if needed
+func (sb *SegmentedBackend) segment(n int, create bool) (*os.File, error) {
+	sb.lock.RLock()
+	if n < len(sb.files) {
+		f := sb.files[n]
+		sb.lock.RUnlock()
+		return f, nil
+	}
+	sb.lock.RUnlock()
+
+	if !create {
+		return nil, io.EOF
+	}
+
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	for len(sb.files) <= n {
+		f, err := os.OpenFile(SegmentFileName(sb.base, len(sb.files)), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		// segments are sparse until chunks are written
+		err = f.Truncate(sb.segmentSize)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		sb.files = append(sb.files, f)
+	}
+	return sb.files[n], nil
+}
+
+// do splits an operation at segment boundaries
+func (sb *SegmentedBackend) do(p []byte, off int64, create bool, op func(f *os.File, p []byte, off int64) (int, error)) (int, error) {
+	done := 0
+	for done < len(p) {
+		n := int(off / sb.segmentSize)
+		segOff := off % sb.segmentSize
+		size := len(p) - done
+		if int64(size) > sb.segmentSize-segOff {
+			size = int(sb.segmentSize - segOff)
+		}
+
+		f, err := sb.segment(n, create)
+		if err != nil {
+			return done, err
+		}
+		written, err := op(f, p[done:done+size], segOff)
+		done += written
+		if err != nil {
+			return done, err
+		}
+		off += int64(written)
+	}
+	return done, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (sb *SegmentedBackend) ReadAt(p []byte, off int64) (int, error) {
+	return sb.do(p, off, false, (*os.File).ReadAt)
+}
+
+// WriteAt implements io.WriterAt
+func (sb *SegmentedBackend) WriteAt(p []byte, off int64) (int, error) {
+	return sb.do(p, off, true, (*os.File).WriteAt)
+}
+
+func (sb *SegmentedBackend) Write(p []byte) (int, error) {
+	n, err := sb.WriteAt(p, sb.pos)
+	sb.pos += int64(n)
+	return n, err
+}
+
+// Sync flushes all the segment files to stable storage
+func (sb *SegmentedBackend) Sync() error {
+	sb.lock.RLock()
+	defer sb.lock.RUnlock()
+	for _, f := range sb.files {
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all the segment files
+func (sb *SegmentedBackend) Close() error {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	var err error
+	for _, f := range sb.files {
+		if cerr := f.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	sb.files = nil
+	return err
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sidecarIndex is a persistent string to item index map kept in a file
+// next to the storage as a log of "<idx> <quoted string>" lines, the last
+// line for a string wins. The log is compacted every time it's opened
+type sidecarIndex struct {
+	filename string
+	file     *os.File
+	entries  map[string]int
+	lock     sync.Mutex
+}
+
+// openSidecarIndex loads an index file calling rebuild to fill
+// the index if the file doesn't exist
+func openSidecarIndex(filename string, rebuild func(entries map[string]int) error) (*sidecarIndex, error) {
+	si := &sidecarIndex{
+		filename: filename,
+		entries:  make(map[string]int),
+	}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		log.Noticef("index %s not found, rebuilding it from the storage", filename)
+		err = rebuild(si.entries)
+		if err != nil {
+			return nil, fmt.Errorf("error rebuilding index: %s", err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		err = si.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading index: %s", err)
+		}
+	}
+
+	err = si.compact()
+	if err != nil {
+		return nil, fmt.Errorf("error compacting index: %s", err)
+	}
+
+	si.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+func (si *sidecarIndex) load(f *os.File) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), MaxMetaSize*2)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		tokens := strings.SplitN(scanner.Text(), " ", 2)
+		if len(tokens) != 2 {
+			return fmt.Errorf("line %d: index and key expected", lineNum)
+		}
+		idx, err := strconv.ParseInt(tokens[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid index '%s'", lineNum, tokens[0])
+		}
+		key, err := strconv.Unquote(tokens[1])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid key %s", lineNum, tokens[1])
+		}
+		si.entries[key] = int(idx)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the index file with the current entries only
+func (si *sidecarIndex) compact() error {
+	tmpName := si.filename + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for key, idx := range si.entries {
+		fmt.Fprintf(w, "%d %s\n", idx, strconv.Quote(key))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, si.filename)
+}
+
+func (si *sidecarIndex) get(key string) (int, bool) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	idx, found := si.entries[key]
+	return idx, found
+}
+
+// set binds key to idx returning the index previously bound to it
+func (si *sidecarIndex) set(key string, idx int) (int, bool, error) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+
+	_, err := fmt.Fprintf(si.file, "%d %s\n", idx, strconv.Quote(key))
+	if err == nil {
+		err = si.file.Sync()
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error writing index %s: %s", si.filename, err)
+	}
+
+	prev, found := si.entries[key]
+	si.entries[key] = idx
+	return prev, found && prev != idx, nil
+}
+
+func (si *sidecarIndex) len() int {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	return len(si.entries)
+}
+
+func (si *sidecarIndex) close() error {
+	return si.file.Close()
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/viert/bookstore/common"
+)
+
+// itemStats are statistics of one or more items. stored is the size of
+// item data in chunks (compressed, along with metadata, not counting
+// encryption overhead), raw is the size of uncompressed item data
+type itemStats struct {
+	items  int64
+	chunks int64
+	stored int64
+	raw    int64
+}
+
+// Stats are statistics of live items of a storage
+type Stats struct {
+	Items       int64
+	UsedChunks  int64
+	StoredBytes int64
+	RawBytes    int64
+}
+
+// Stats returns statistics of live items kept in the storage header.
+// ok is false if the statistics can't be trusted, i.e. the storage has
+// been upgraded or its header recovered, use RebuildStats then
+func (s *Storage) Stats() (stats Stats, ok bool) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	stats = Stats{
+		Items:       s.header.Items,
+		UsedChunks:  s.header.UsedChunks,
+		StoredBytes: s.header.StoredBytes,
+		RawBytes:    s.header.RawBytes,
+	}
+	return stats, s.header.Version >= statsVersion && s.header.StatsValid != 0
+}
+
+// statsRebuild is the state of RebuildStats in progress. Items before
+// cursor are counted already so changes made to them meanwhile are
+// collected in delta. invalid is set if some change couldn't be counted
+type statsRebuild struct {
+	cursor  int
+	delta   itemStats
+	invalid bool
+}
+
+func (st *itemStats) add(other itemStats, sign int64) {
+	st.items += sign * other.items
+	st.chunks += sign * other.chunks
+	st.stored += sign * other.stored
+	st.raw += sign * other.raw
+}
+
+// addStats adds (sign=1) or subtracts (sign=-1) statistics of the item
+// starting at idx to the header counters. Must be called with locker held
+func (s *Storage) addStats(idx int, st itemStats, sign int64) {
+	s.header.Items += sign * st.items
+	s.header.UsedChunks += sign * st.chunks
+	s.header.StoredBytes += sign * st.stored
+	s.header.RawBytes += sign * st.raw
+	if s.rebuild != nil && idx < s.rebuild.cursor {
+		s.rebuild.delta.add(st, sign)
+	}
+}
+
+// readItemStats returns statistics of the item starting at idx walking
+// its chunk headers. head is the first chunk header. The uncompressed size
+// is read from the first chunk, items written before sizeVersion are read
+// through to get it
+func (s *Storage) readItemStats(idx int, head *chunkHeader) (itemStats, error) {
+	st := itemStats{items: 1}
+	for header := head; ; {
+		st.chunks++
+		st.stored += int64(header.DataSize)
+		if header.KeyID != 0 {
+			st.stored -= gcmOverhead
+		}
+		if header.Next < 0 {
+			break
+		}
+		var err error
+		header, _, err = s.readVisibleChunkHeader(int(header.Next))
+		if err != nil {
+			return itemStats{}, err
+		}
+	}
+
+	if head.Flags&chunkSized != 0 {
+		chain, err := s.newChainReader(idx)
+		if err != nil {
+			return itemStats{}, err
+		}
+		st.raw, err = readSize(chain)
+		return st, err
+	}
+
+	ir, err := s.openItem(idx)
+	if err != nil {
+		return itemStats{}, err
+	}
+	defer ir.Close()
+	st.raw, err = io.Copy(ioutil.Discard, ir)
+	return st, err
+}
+
+// chunkStats returns the header of chunk idx and statistics of the item
+// starting at it, zero statistics if the chunk doesn't start a live item
+func (s *Storage) chunkStats(idx int) (*chunkHeader, itemStats, error) {
+	header, _, err := s.readVisibleChunkHeader(idx)
+	if err != nil {
+		return nil, itemStats{}, err
+	}
+	if !s.startsItem(header) {
+		return header, itemStats{}, nil
+	}
+	st, err := s.readItemStats(idx, header)
+	return header, st, err
+}
+
+// liveItemStats returns statistics of the item starting at idx if it's
+// a live one, zero statistics otherwise. It's used to account for items
+// which are about to be overwritten or deleted so it must be called with
+// writeLock held
+func (s *Storage) liveItemStats(idx int) (itemStats, error) {
+	if idx < 0 || idx >= s.highWaterMark() {
+		return itemStats{}, nil
+	}
+	_, st, err := s.chunkStats(idx)
+	return st, err
+}
+
+// removeStats subtracts statistics of a removed item. If they couldn't
+// be read (err is not nil) the counters are marked invalid instead.
+// Must be called with locker held
+func (s *Storage) removeStats(idx int, st itemStats, err error) {
+	if err != nil {
+		log.Warningf("error reading item %d, storage statistics need to be rebuilt: %s", idx, err)
+		s.header.StatsValid = 0
+		if s.rebuild != nil {
+			s.rebuild.invalid = true
+		}
+		return
+	}
+	s.addStats(idx, st, -1)
+}
+
+// RebuildStats recounts statistics of live items. Items are walked without
+// locks, locker is taken for a moment to check every item hasn't changed
+// since it's been counted. Changes made to items counted already are
+// collected separately, so neither reads nor writes are blocked
+func (s *Storage) RebuildStats() (Stats, error) {
+	if s.header.Version < statsVersion {
+		return Stats{}, common.NewHTTPError(400, "storage version %d has no room for statistics, upgrade it first", s.header.Version)
+	}
+
+	s.locker.Lock()
+	if s.rebuild != nil {
+		s.locker.Unlock()
+		return Stats{}, common.NewHTTPError(409, "storage statistics are being rebuilt already")
+	}
+	s.rebuild = &statsRebuild{}
+	s.locker.Unlock()
+
+	var total itemStats
+	idx := 0
+	for {
+		s.locker.Lock()
+		if idx >= s.highWaterMark() {
+			// locker is kept to apply the result
+			break
+		}
+		s.locker.Unlock()
+
+		header, st, err := s.chunkStats(idx)
+
+		s.locker.Lock()
+		current, _, cerr := s.readVisibleChunkHeader(idx)
+		if cerr == nil && (header == nil || *current != *header) {
+			// the chunk has been rewritten, it's counted again
+			s.locker.Unlock()
+			continue
+		}
+		if cerr == nil {
+			cerr = err
+		}
+		if cerr != nil {
+			s.rebuild = nil
+			s.locker.Unlock()
+			return Stats{}, cerr
+		}
+		total.add(st, 1)
+		idx++
+		s.rebuild.cursor = idx
+		s.locker.Unlock()
+	}
+	defer s.locker.Unlock()
+
+	rb := s.rebuild
+	s.rebuild = nil
+	total.add(rb.delta, 1)
+	// finished items waiting to be published are past the high-water mark
+	for _, r := range s.pending {
+		if r.done && !r.failed {
+			total.add(r.stats, 1)
+		}
+	}
+
+	s.header.Items = total.items
+	s.header.UsedChunks = total.chunks
+	s.header.StoredBytes = total.stored
+	s.header.RawBytes = total.raw
+	if rb.invalid {
+		s.header.StatsValid = 0
+	} else {
+		s.header.StatsValid = 1
+	}
+	err := s.writeHeader()
+	if err != nil {
+		log.Errorf("error writing storage header: %s", err)
+		return Stats{}, err
+	}
+	if rb.invalid {
+		return Stats{}, common.NewHTTPError(409, "storage has changed in a way which can't be counted, rebuild statistics again")
+	}
+	return Stats{
+		Items:       total.items,
+		UsedChunks:  total.chunks,
+		StoredBytes: total.stored,
+		RawBytes:    total.raw,
+	}, nil
+}
@@ -2,11 +2,15 @@ package storage
 
 import (
 	"bytes"
-	"compress/gzip"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	logging "github.com/op/go-logging"
 	"github.com/viert/bookstore/common"
@@ -19,19 +23,85 @@ const (
 	MaxChunkSize = 65536
 	// MaxNumChunks holds the maximum number of chunks (~132Gb for 1024k-chunk)
 	MaxNumChunks = 0x8000000
+	// MaxSegmentedNumChunks holds the maximum number of chunks of a segmented storage
+	MaxSegmentedNumChunks = math.MaxInt32
 
-	storageVersion = 1
+	storageVersion = 6
+	// minStorageVersion is the oldest file version which can still be opened.
+	// Version 1 files have no chunk checksums
+	minStorageVersion = 1
+	// checksumVersion is the first version having chunk checksums
+	checksumVersion = 2
+	// slotVersion is the first version having double-buffered header slots
+	slotVersion = 3
+	// headVersion is the first version having first chunks of all the items
+	// marked with chunkHead
+	headVersion = 4
+	// statsVersion is the first version keeping item statistics in the header
+	statsVersion = 5
+	// sizeVersion is the first version keeping uncompressed sizes of items
+	// in their first chunks (see chunkSized)
+	sizeVersion = 6
+
+	// sizePrefixSize is the size of the uncompressed size of an item
+	sizePrefixSize = 8
 )
 
 var (
 	log = logging.MustGetLogger("bookstore")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
+// ChecksumError is returned when chunk data doesn't match
+// the checksum stored in its header, i.e. the data is corrupted
+type ChecksumError struct {
+	Idx      int
+	Expected uint32
+	Actual   uint32
+}
+
+func (ce ChecksumError) Error() string {
+	return fmt.Sprintf("chunk %d is corrupted: checksum is %08x, expected %08x",
+		ce.Idx, ce.Actual, ce.Expected)
+}
+
 // Storage is the main type representing the bookstore storage
 type Storage struct {
-	backend Backend
-	header  storeHeader
-	locker  sync.RWMutex
+	backend    Backend
+	header     storeHeader
+	free       freeList
+	durability Durability
+	group      *groupSyncer
+	codec      Codec
+	dict       *dictCodec
+	keys       *Keyring
+	cache      *itemCache
+	// hwm is FreeChunkIdx published for readers. Readers take no locks,
+	// chunks below hwm are fully written and positional reads of them
+	// don't depend on any mutable state
+	hwm    int32
+	locker sync.RWMutex
+	// tail is the first chunk past all the reservations, pending holds
+	// tail reservations not published yet (see reservation)
+	tail          int
+	pending       []*reservation
+	publishedCond *sync.Cond
+	// rebuild is set while RebuildStats is running
+	rebuild *statsRebuild
+	// gen is the generation counter of written items (see nextGen)
+	gen uint32
+	// readOnly is set for storages opened with OpenReadOnly
+	readOnly bool
+	// nextExpiry is the earliest expiration time of items known to
+	// the reaper, notedExpiry is the earliest one of items written since
+	// the reaper has started the last scan (see ReapExpired)
+	nextExpiry  uint32
+	notedExpiry uint32
+	// writeLock serializes reservations and writes to given indices.
+	// It's always taken before locker and may be held for long (see
+	// ItemWriter) without blocking readers
+	writeLock sync.Mutex
 }
 
 // ReplicationCallback represents a function type for
@@ -50,191 +120,846 @@ func NopReplicationCallback(idx int) error {
 
 // Open initializes a Storage instance from a given backend (typically a rw-opened file)
 func Open(backend Backend) (*Storage, error) {
+	return open(backend, false)
+}
+
+// OpenReadOnly opens a storage which is only going to be read, e.g. a file
+// opened read-only. A stale header is recovered in memory without writing
+// anything back to the backend
+func OpenReadOnly(backend Backend) (*Storage, error) {
+	return open(backend, true)
+}
+
+func open(backend Backend, readOnly bool) (*Storage, error) {
 	s := new(Storage)
 	s.backend = backend
+	s.readOnly = readOnly
+	s.codec = gzipCodec{}
 	err := s.readHeader()
 	if err != nil {
 		log.Errorf("error reading storage header: %s", err)
 		return nil, err
 	}
+	err = s.loadFreeList()
+	if err != nil {
+		log.Errorf("error loading free list: %s", err)
+		return nil, err
+	}
+	s.tail = int(s.header.FreeChunkIdx)
+	s.publishedCond = sync.NewCond(&s.locker)
+	// generations of items written before the storage has been
+	// opened are unknown so the counter starts at a random point
+	s.gen = uint32(time.Now().UnixNano())
+	s.notedExpiry = noExpiry
+	s.publish()
 	return s, nil
 }
 
+// nextGen returns the generation of a new item. Zero is skipped
+// since it's the generation of all the chunks written before
+func (s *Storage) nextGen() uint8 {
+	for {
+		gen := uint8(atomic.AddUint32(&s.gen, 1))
+		if gen != 0 {
+			return gen
+		}
+	}
+}
+
+// publish makes chunks below FreeChunkIdx visible to readers
+func (s *Storage) publish() {
+	atomic.StoreInt32(&s.hwm, s.header.FreeChunkIdx)
+}
+
+// highWaterMark returns the number of chunks visible to readers
+func (s *Storage) highWaterMark() int {
+	return int(atomic.LoadInt32(&s.hwm))
+}
+
 func (s *Storage) readHeader() error {
 
-	s.locker.RLock()
-	defer s.locker.RUnlock()
+	s.locker.Lock()
+	defer s.locker.Unlock()
 
-	p := make([]byte, storeHeaderSize)
-	_, err := s.backend.ReadAt(p, 0)
+	header, valid, err := readStoreHeader(s.backend)
 	if err != nil {
 		return err
 	}
-	buf := bytes.NewBuffer(p)
-	err = binary.Read(buf, binaryLayout, &s.header)
+	s.header = *header
+
+	if s.header.Version < minStorageVersion || s.header.Version > storageVersion {
+		return fmt.Errorf("storage version mismatch: file version is %d, software supports versions %d to %d",
+			s.header.Version, minStorageVersion, storageVersion)
+	}
+
+	if !valid {
+		log.Warning("both storage header slots are damaged, recovering header from chunks")
+		return s.recoverHeader()
+	}
+	return s.skipWrittenChunks()
+}
+
+// skipWrittenChunks advances FreeChunkIdx past items written after it.
+// The header may be stale if the storage hasn't been closed properly,
+// besides chunks past FreeChunkIdx may be written by concurrent writers
+// in any order, so every complete item (or a tombstone) found right past
+// FreeChunkIdx is taken as written. Failed writes clear their first chunks
+// so they aren't taken for items. Storages older than headVersion are
+// trusted as they are: first chunks of items can't be told from the rest
+// and older software left failed writes behind
+func (s *Storage) skipWrittenChunks() error {
+	if s.header.Version < headVersion {
+		return nil
+	}
+	end, unwritten, err := s.writtenEnd(int(s.header.FreeChunkIdx), false)
+	if err != nil {
+		return err
+	}
+	if end == int(s.header.FreeChunkIdx) {
+		return nil
+	}
+
+	log.Warningf("found chunks written past free chunk index %d, advancing it to %d", s.header.FreeChunkIdx, end)
+	s.header.FreeChunkIdx = int32(end)
+	s.header.StatsValid = 0
+	if s.readOnly {
+		// unwritten chunks don't start items so readers skip them
+		return nil
+	}
+	err = s.tombstoneUnwritten(unwritten)
+	if err != nil {
+		return err
+	}
+	return s.writeHeader()
+}
+
+// writtenEnd walks chunks starting at from and returns the end of the
+// written ones along with unwritten chunks below it, those belong to items
+// which were being written when the storage was closed. Chains may
+// interleave (see ItemWriter) so chunks are checked one by one and the end
+// is the farthest end of a written chain. Unless scanAll is set the walk
+// stops at the first chunk past the end which doesn't start a written chain,
+// otherwise damaged chunks are kept below the end to be reported on reads
+func (s *Storage) writtenEnd(from int, scanAll bool) (int, []int, error) {
+	end := from
+	unwritten := make([]int, 0)
+	idx := from
+	for idx < int(s.header.NumChunks) {
+		next, err := s.writtenChainEnd(idx)
+		if err != nil {
+			return -1, nil, err
+		}
+		if next >= 0 {
+			if next > end {
+				end = next
+			}
+			if s.header.Version < headVersion {
+				// chains of older storages are contiguous
+				idx = next
+			} else {
+				idx++
+			}
+			continue
+		}
+
+		header, err := s.readChunkHeader(idx)
+		if err != nil {
+			return -1, nil, err
+		}
+		if idx >= end && !scanAll {
+			break
+		}
+		if header.DataSize == 0 && header.Flags == 0 {
+			unwritten = append(unwritten, idx)
+		} else if idx >= end {
+			end = idx + 1
+		}
+		idx++
+	}
+
+	for i, idx := range unwritten {
+		if idx >= end {
+			unwritten = unwritten[:i]
+			break
+		}
+	}
+	return end, unwritten, nil
+}
+
+// tombstoneUnwritten marks chunks left unwritten below FreeChunkIdx as
+// deleted so they're reused
+func (s *Storage) tombstoneUnwritten(unwritten []int) error {
+	for _, idx := range unwritten {
+		err := s.writeChunkHeader(idx, &chunkHeader{Next: -1, Flags: chunkDeleted})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writtenChainEnd checks if chunk idx is a tombstone or the first chunk
+// of a completely written item. Returns the index past the tombstone or
+// the last chunk of the item, -1 if the chunk is neither
+func (s *Storage) writtenChainEnd(idx int) (int, error) {
+	header, err := s.readChunkHeader(idx)
+	if err != nil {
+		return -1, err
+	}
+	if header.isDeleted() {
+		return idx + 1, nil
+	}
+	if header.DataSize == 0 && header.Flags == 0 {
+		// never written
+		return -1, nil
+	}
+	if s.header.Version >= headVersion && !header.isHead() {
+		return -1, nil
+	}
+
+	curr := idx
+	end := idx + 1
+	// chains of item writers may go back to reused chunks so the number
+	// of steps is bounded to catch loops
+	for steps := 0; steps < int(s.header.NumChunks); steps++ {
+		if !s.chunkIntact(curr, header) {
+			return -1, nil
+		}
+		if curr+1 > end {
+			end = curr + 1
+		}
+		next := int(header.Next)
+		if next < 0 {
+			return end, nil
+		}
+		if next >= int(s.header.NumChunks) || (s.header.Version < headVersion && next <= curr) {
+			return -1, nil
+		}
+		curr = next
+		header, err = s.readChunkHeader(curr)
+		if err != nil {
+			return -1, err
+		}
+		if header.isDeleted() || header.isHead() {
+			return -1, nil
+		}
+	}
+	return -1, nil
+}
+
+// chunkIntact checks if data of chunk idx matches its header
+func (s *Storage) chunkIntact(idx int, header *chunkHeader) bool {
+	if header.DataSize < 0 || int(header.DataSize) > s.GetChunkDataSize() {
+		return false
+	}
+	if s.header.Version < checksumVersion {
+		return true
+	}
+	data, err := s.readAt(nil, int(header.DataSize), s.header.chunkOffset(idx)+int64(chunkHeaderSize))
+	if err != nil {
+		return false
+	}
+	return crc32.Checksum(data, crcTable) == header.Checksum
+}
+
+// recoverHeader re-derives FreeChunkIdx from chunk headers and rewrites
+// both header slots. Concurrent writers may leave chunks unwritten in
+// between of items so all the chunks are checked, FreeChunkIdx is put
+// past the last chunk written. Chunks below it which have never been
+// written are turned into tombstones
+func (s *Storage) recoverHeader() error {
+	end, unwritten, err := s.writtenEnd(0, true)
 	if err != nil {
 		return err
 	}
 
-	if s.header.Version != storageVersion {
-		return fmt.Errorf("storage version mismatch: file version is %d, software version is %d",
-			s.header.Version, storageVersion)
+	log.Warningf("recovered free chunk index is %d (header said %d)", end, s.header.FreeChunkIdx)
+	s.header.FreeChunkIdx = int32(end)
+	// the header may be stale so statistics have to be rebuilt
+	s.header.StatsValid = 0
+	if s.readOnly {
+		return nil
 	}
 
+	err = s.tombstoneUnwritten(unwritten)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < headerSlotCount; i++ {
+		err := s.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// writeHeader persists the storage header. Slotted storages get the
+// sequence number incremented and the header written to the older slot
 func (s *Storage) writeHeader() error {
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.LittleEndian, &s.header)
-	_, err := s.backend.WriteAt(buf.Bytes(), 0)
+	if s.header.Version < slotVersion {
+		_, err := s.backend.WriteAt(encodeLegacyHeader(&s.header), 0)
+		return err
+	}
+	s.header.Seq++
+	slot := int(s.header.Seq % headerSlotCount)
+	_, err := s.backend.WriteAt(encodeHeader(&s.header), int64(slot*storeHeaderSize))
 	return err
 }
 
-func (s *Storage) getChunkPosition(idx int) int {
-	if idx >= int(s.header.NumChunks) || idx < 0 {
-		return -1
-	}
-	return storeHeaderSize + idx*int(s.header.ChunkSize)
+// loadFreeList rebuilds the list of free chunks from tombstones
+// left by deleted items
+func (s *Storage) loadFreeList() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
 
+	s.free = freeList{}
+	for idx := 0; idx < int(s.header.FreeChunkIdx); idx++ {
+		header, err := s.readChunkHeader(idx)
+		if err != nil {
+			return err
+		}
+		if header.isDeleted() {
+			s.free.add(idx, 1)
+		}
+	}
+	return nil
 }
 
-func zip(data []byte) (*bytes.Buffer, error) {
-	var buf bytes.Buffer
-	zw := gzip.NewWriter(&buf)
-	defer zw.Close()
-	_, err := zw.Write(data)
+// readAt returns n bytes of backend data at off. Backends implementing
+// Slicer return the data as is, others read it into buf which is
+// reallocated if it's too small. The result must not be modified
+func (s *Storage) readAt(buf []byte, n int, off int64) ([]byte, error) {
+	if slicer, ok := s.backend.(Slicer); ok {
+		return slicer.Slice(off, n)
+	}
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	_, err := s.backend.ReadAt(buf, off)
 	if err != nil {
 		return nil, err
 	}
-	return &buf, nil
+	return buf, nil
 }
 
-func unzip(data *bytes.Buffer) ([]byte, error) {
-	zr, err := gzip.NewReader(data)
+func (s *Storage) readChunkHeader(idx int) (*chunkHeader, error) {
+	var header chunkHeader
+	pos := s.getChunkPosition(idx)
+	if pos < 0 {
+		return nil, common.NewHTTPError(404, "index %d out of bounds", idx)
+	}
+
+	headerBytes, err := s.readAt(nil, chunkHeaderSize, int64(pos))
 	if err != nil {
-		return nil, err
+		return nil, common.NewHTTPError(500, "error reading chunk header: %s", err)
 	}
-	defer zr.Close()
-	out, err := ioutil.ReadAll(zr)
+	err = binary.Read(bytes.NewReader(headerBytes), binaryLayout, &header)
 	if err != nil {
-		return nil, err
+		return nil, common.NewHTTPError(500, "error parsing chunk header: %s", err)
 	}
-	return out, nil
+	return &header, nil
 }
 
-func (s *Storage) writeTo(buf *bytes.Buffer, idx int, callback ReplicationCallback, gzipped bool) (int, error) {
+// readVisibleChunkHeader reads the header of a chunk below the high-water
+// mark without locking. Returns the header and the chunk position
+func (s *Storage) readVisibleChunkHeader(idx int) (*chunkHeader, int64, error) {
+	var header chunkHeader
+	if idx >= s.highWaterMark() || idx < 0 {
+		return nil, 0, common.NewHTTPError(404, "index %d out of bounds", idx)
+	}
+	pos := s.header.chunkOffset(idx)
+
+	headerBytes, err := s.readAt(nil, chunkHeaderSize, pos)
+	if err != nil {
+		return nil, 0, common.NewHTTPError(500, "error reading chunk header: %s", err)
+	}
+	err = binary.Read(bytes.NewReader(headerBytes), binaryLayout, &header)
+	if err != nil {
+		return nil, 0, common.NewHTTPError(500, "error parsing chunk header: %s", err)
+	}
+	return &header, pos, nil
+}
+
+func (s *Storage) writeChunkHeader(idx int, header *chunkHeader) error {
+	var buf bytes.Buffer
+	pos := s.getChunkPosition(idx)
+	if pos < 0 {
+		return fmt.Errorf("index out of bounds")
+	}
+	binary.Write(&buf, binaryLayout, header)
+	_, err := s.backend.WriteAt(buf.Bytes(), int64(pos))
+	return err
+}
+
+// setChainFlags rewrites headers of the given chunks
+// setting or clearing the given flags
+func (s *Storage) setChainFlags(chunks []int, flags uint8, set bool) error {
+	for _, idx := range chunks {
+		header, err := s.readChunkHeader(idx)
+		if err != nil {
+			return err
+		}
+		if set {
+			header.Flags |= flags
+		} else {
+			header.Flags &^= flags
+		}
+		err = s.writeChunkHeader(idx, header)
+		if err != nil {
+			return common.NewHTTPError(500, "error writing chunk header: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) chunksNeeded(dataSize int) int {
+	chunkDataSize := s.chunkPayloadSize()
+	n := (dataSize + chunkDataSize - 1) / chunkDataSize
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (s *Storage) getChunkPosition(idx int) int {
+	if idx >= int(s.header.NumChunks) || idx < 0 {
+		return -1
+	}
+	return int(s.header.chunkOffset(idx))
+}
+
+// ensureChunk checks if chunk idx is within the storage. Segmented storages
+// get new segments on demand. Must be called with both locks held
+func (s *Storage) ensureChunk(idx int) error {
+	if idx < int(s.header.NumChunks) {
+		return nil
+	}
+	if !s.header.segmented() || idx >= MaxSegmentedNumChunks {
+		return fmt.Errorf("storage is full")
+	}
+	return s.addSegments(idx + 1)
+}
+
+// writeChunks writes an item into chunks starting from idx without committing
+// them. Chunks must be within the storage (see ensureChunk). Chunks which are
+// already visible are written as tombstones with flags=chunkDeleted and
+// revived only on commit. Item flags, chunkHead and ExpiresAt are set on
+// the first chunk only. An empty item still takes a chunk so whatever the
+// chunk has held before is never revived
+func (s *Storage) writeChunks(item *EncodedItem, idx int, flags uint8) ([]int, error) {
 	var header chunkHeader
-	var headerBuffer bytes.Buffer
 	var bytesToWrite int
-	var err error
 
 	currChunk := idx
-	maxChunkDataSize := s.GetChunkDataSize()
-	bytesLeft := buf.Len()
+	maxChunkDataSize := s.chunkPayloadSize()
+	bytesLeft := len(item.Payload)
 
-	dataBuffer := buf.Bytes()
+	dataBuffer := item.Payload
 	dataBufferIdx := 0
 
-	for bytesLeft > 0 {
-		log.Debugf("current chunk idx=%d", currChunk)
-		if currChunk >= int(s.header.NumChunks) {
-			return -1, fmt.Errorf("storage is full")
-		}
-		pos := s.getChunkPosition(currChunk)
-		if pos < 0 {
-			return -1, fmt.Errorf("index out of bounds")
-		}
+	chunks := make([]int, 0, s.chunksNeeded(bytesLeft))
+	gen := s.nextGen()
 
+	for bytesLeft > 0 || len(chunks) == 0 {
+		log.Debugf("current chunk idx=%d", currChunk)
 		if bytesLeft > maxChunkDataSize {
 			log.Debugf("Data size (%d) is greater than max chunk data size (%d)",
 				bytesLeft, maxChunkDataSize)
 			header = chunkHeader{
-				DataSize:   int32(maxChunkDataSize),
-				Next:       int32(currChunk + 1),
-				Compressed: gzipped,
+				DataSize: int32(maxChunkDataSize),
+				Next:     int32(currChunk + 1),
+				Codec:    item.Codec,
+				Flags:    flags,
+				Gen:      gen,
 			}
 			bytesToWrite = maxChunkDataSize
 		} else {
 			header = chunkHeader{
-				DataSize:   int32(bytesLeft),
-				Next:       -1,
-				Compressed: gzipped,
+				DataSize: int32(bytesLeft),
+				Next:     -1,
+				Codec:    item.Codec,
+				Flags:    flags,
+				Gen:      gen,
 			}
 			bytesToWrite = bytesLeft
 		}
+		if currChunk == idx {
+			header.Flags |= item.Flags | chunkHead
+			header.ExpiresAt = item.ExpiresAt
+			s.noteExpiry(item.ExpiresAt)
+		}
 		bytesLeft -= bytesToWrite
+		chunkData := dataBuffer[dataBufferIdx : dataBufferIdx+bytesToWrite]
+
+		err := s.writeChunk(currChunk, &header, chunkData)
+		if err != nil {
+			return nil, err
+		}
+
+		dataBufferIdx += bytesToWrite
+		chunks = append(chunks, currChunk)
+		currChunk++
+	}
+
+	return chunks, nil
+}
 
-		// preparing header buffer
-		headerBuffer.Reset()
-		binary.Write(&headerBuffer, binaryLayout, &header)
+// writeChunk writes a single chunk header and data computing the checksum.
+// Data is encrypted if the storage has keys loaded. The chunk must be
+// within the storage, NumChunks isn't checked since it may be changed
+// concurrently by writers holding the lock
+func (s *Storage) writeChunk(idx int, header *chunkHeader, data []byte) error {
+	var headerBuffer bytes.Buffer
 
-		// writing header buffer contents at proper position in backend
-		n, err := s.backend.WriteAt(headerBuffer.Bytes(), int64(pos))
+	if idx < 0 {
+		return fmt.Errorf("index out of bounds")
+	}
+	pos := s.header.chunkOffset(idx)
+
+	if s.keys != nil {
+		var err error
+		data, err = s.keys.seal(idx, header, data)
 		if err != nil {
-			return -1, common.NewHTTPError(500, "error writing chunk header: %s", err)
+			return common.NewHTTPError(500, "error encrypting chunk: %s", err)
 		}
-		log.Debugf("wrote %d bytes of chunk header at %d", n, pos)
+	}
+	header.DataSize = int32(len(data))
+	header.Checksum = crc32.Checksum(data, crcTable)
+	binary.Write(&headerBuffer, binaryLayout, header)
+
+	// writing header buffer contents at proper position in backend
+	n, err := s.backend.WriteAt(headerBuffer.Bytes(), pos)
+	if err != nil {
+		return common.NewHTTPError(500, "error writing chunk header: %s", err)
+	}
+	log.Debugf("wrote %d bytes of chunk header at %d", n, pos)
 
-		// writing bytesToWrite bytes of actual data right after the header
-		n, err = s.backend.WriteAt(dataBuffer[dataBufferIdx:dataBufferIdx+bytesToWrite],
-			int64(pos+chunkHeaderSize))
+	// writing actual data right after the header
+	n, err = s.backend.WriteAt(data, pos+int64(chunkHeaderSize))
+	if err != nil {
+		return common.NewHTTPError(500, "error writing chunk data: %s", err)
+	}
+	log.Debugf("wrote %d bytes of data at %d", n, pos)
+	return nil
+}
+
+// commit makes chains written by writeChunks to given indices visible:
+// reused chunks are revived and removed from the free list, FreeChunkIdx
+// is advanced past the last written chunk. Chunks skipped between the old
+// and the new FreeChunkIdx become tombstones, so a replica receiving items
+// out of order has free chunks for the items arriving later. Must be
+// called with both locks held and no pending reservations
+func (s *Storage) commit(chains [][]int) error {
+	freeChunkIdx := int(s.header.FreeChunkIdx)
+	written := make(map[int]bool)
+	for _, chunks := range chains {
+		if len(chunks) == 0 {
+			continue
+		}
+		if chunks[0] < int(s.header.FreeChunkIdx) {
+			err := s.setChainFlags(chunks, chunkDeleted, false)
+			if err != nil {
+				log.Errorf("error committing chunks: %s", err)
+				return err
+			}
+			s.invalidateCache(chunks[0])
+		}
+		s.free.claim(chunks[0], len(chunks))
+		for _, chunk := range chunks {
+			written[chunk] = true
+		}
+		end := chunks[len(chunks)-1] + 1
+		if end > freeChunkIdx {
+			freeChunkIdx = end
+		}
+	}
+
+	if freeChunkIdx > int(s.header.FreeChunkIdx) {
+		for idx := int(s.header.FreeChunkIdx); idx < freeChunkIdx; idx++ {
+			if !written[idx] {
+				s.tombstone(idx, 1)
+			}
+		}
+		s.header.FreeChunkIdx = int32(freeChunkIdx)
+		s.tail = freeChunkIdx
+		err := s.writeHeader()
 		if err != nil {
-			return -1, common.NewHTTPError(500, "error writing chunk data: %s", err)
+			log.Errorf("error writing storage header: %s", err)
+			return common.NewHTTPError(500, "error writing storage header: %s", err)
 		}
-		log.Debugf("wrote %d bytes of data at %d", n, pos)
+		s.publish()
+	}
+	return nil
+}
 
-		dataBufferIdx += bytesToWrite
-		currChunk++
+// EncodedItem is an item the way it's stored in chunks: data compressed
+// with Codec and prefixed with its size and metadata record as Flags say.
+// Master replicates items encoded so replicas store exactly the same chunks
+// no matter which codec they're configured with. KeyID is the key chunks
+// are to be encrypted with, zero if they aren't
+type EncodedItem struct {
+	Payload   []byte `json:"payload"`
+	RawSize   int    `json:"raw_size"`
+	Codec     uint8  `json:"codec"`
+	Flags     uint8  `json:"flags"`
+	ExpiresAt uint32 `json:"expires_at,omitempty"`
+	KeyID     uint8  `json:"key_id,omitempty"`
+}
+
+// stats returns statistics of the item written into given number of chunks
+func (it *EncodedItem) stats(chunks int) itemStats {
+	return itemStats{1, int64(chunks), int64(len(it.Payload)), int64(it.RawSize)}
+}
+
+// EncodeItem compresses data and prepends its size (since sizeVersion)
+// and a metadata record if meta is not nil
+func (s *Storage) EncodeItem(data []byte, meta *ItemMeta) (*EncodedItem, error) {
+	buf, codec, err := s.prepareData(data)
+	if err != nil {
+		return nil, err
+	}
+	item := &EncodedItem{Payload: buf.Bytes(), RawSize: len(data), Codec: codec}
+	if s.keys != nil {
+		item.KeyID = s.keys.ActiveKeyID()
 	}
 
-	if callback != nil {
+	var prefix []byte
+	if s.header.Version >= sizeVersion {
+		prefix = make([]byte, sizePrefixSize)
+		binaryLayout.PutUint64(prefix, uint64(len(data)))
+		item.Flags |= chunkSized
+	}
+	if meta != nil {
+		item.ExpiresAt, err = meta.expiresAt()
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.metaRecord(meta, len(data), codec)
+		if err != nil {
+			return nil, err
+		}
+		prefix = append(prefix, record...)
+		item.Flags |= chunkMeta
+	}
+
+	if len(prefix) > 0 {
+		item.Payload = append(prefix, item.Payload...)
+	}
+	return item, nil
+}
+
+// checkEncoded checks an item encoded elsewhere (i.e. by master)
+// can be stored the same way here
+func (s *Storage) checkEncoded(item *EncodedItem) error {
+	if _, err := s.codecByID(item.Codec); err != nil {
+		return common.NewHTTPError(400, "%s", err)
+	}
+	if item.Flags&^(chunkMeta|chunkSized) != 0 {
+		return common.NewHTTPError(400, "invalid item flags %d", item.Flags)
+	}
+	if item.Flags&chunkSized != 0 && s.header.Version < sizeVersion {
+		return common.NewHTTPError(400, "storage version %d can't keep item sizes", s.header.Version)
+	}
+	var keyID uint8
+	if s.keys != nil {
+		keyID = s.keys.ActiveKeyID()
+	}
+	if item.KeyID != keyID {
+		return common.NewHTTPError(409, "item is to be encrypted with key %d, active key is %d", item.KeyID, keyID)
+	}
+	return nil
+}
+
+// checkRoom makes sure an item written to idx won't run into the first
+// chunk of a live item following it
+func (s *Storage) checkRoom(idx int, item *EncodedItem) error {
+	if s.header.Version < headVersion {
+		return nil
+	}
+	end := idx + s.chunksNeeded(len(item.Payload))
+	if hwm := s.highWaterMark(); end > hwm {
+		end = hwm
+	}
+	for next := idx + 1; next < end; next++ {
+		header, err := s.readChunkHeader(next)
+		if err != nil {
+			return common.NewHTTPError(500, "error reading chunk header: %s", err)
+		}
+		if header.isHead() && !header.isDeleted() {
+			return common.NewHTTPError(409, "item %d would overwrite item %d", idx, next)
+		}
+	}
+	return nil
+}
+
+// writeTo writes and commits an item to a given index holding both locks
+// for the whole time, which is fine for replicas getting items one by one
+func (s *Storage) writeTo(item *EncodedItem, idx int, callback ReplicationCallback) (int, error) {
+	s.waitPending()
+	err := s.ensureChunk(idx + s.chunksNeeded(len(item.Payload)) - 1)
+	if err != nil {
+		return -1, err
+	}
+	err = s.checkRoom(idx, item)
+	if err != nil {
+		return -1, err
+	}
+	replaced, rerr := s.liveItemStats(idx)
+
+	var flags uint8
+	if idx < int(s.header.FreeChunkIdx) {
+		flags = chunkDeleted
+	}
+	chunks, err := s.writeChunks(item, idx, flags)
+	if err == nil && callback != nil {
 		err = callback(idx)
 		// replication is kinda atomic. so if it fails, local write
 		// must fail as well
 		if err != nil {
-			return -1, common.NewHTTPError(500, "replication error: %s", err)
+			err = common.NewHTTPError(500, "replication error: %s", err)
 		}
 	}
+	if err != nil {
+		s.clearUncommitted(idx)
+		return -1, err
+	}
 
-	s.header.FreeChunkIdx = int32(currChunk)
+	err = s.commit([][]int{chunks})
+	if err != nil {
+		return -1, err
+	}
+
+	s.removeStats(idx, replaced, rerr)
+	s.addStats(idx, item.stats(len(chunks)), 1)
 	err = s.writeHeader()
 	if err != nil {
 		log.Errorf("error writing storage header: %s", err)
 		return -1, common.NewHTTPError(500, "error writing storage header: %s", err)
 	}
-
 	return idx, nil
 }
 
-// WriteTo writes data into chunks starting from given idx
-func (s *Storage) WriteTo(data []byte, idx int, callback ReplicationCallback) (int, error) {
+// clearUncommitted clears the first chunk of a chain written past
+// FreeChunkIdx which isn't going to be committed, so it isn't taken for
+// a written item if the storage is reopened (see skipWrittenChunks).
+// Chains written below FreeChunkIdx are tombstones already. Must be
+// called with both locks held
+func (s *Storage) clearUncommitted(idx int) {
+	if idx < int(s.header.FreeChunkIdx) {
+		return
+	}
+	err := s.writeChunkHeader(idx, &chunkHeader{})
+	if err != nil {
+		log.Errorf("error clearing chunk %d: %s", idx, err)
+	}
+}
+
+// appendItem reserves chunks for an item under the locks, then writes and
+// replicates it with no locks held, so appends don't wait for each other's
+// replication round trips
+func (s *Storage) appendItem(item *EncodedItem, callback ReplicationCallback) (int, error) {
+	s.writeLock.Lock()
+	s.locker.Lock()
+	r, err := s.reserve(s.chunksNeeded(len(item.Payload)))
+	s.locker.Unlock()
+	s.writeLock.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	r.stats = item.stats(r.count)
+
+	_, err = s.writeChunks(item, r.start, r.chunkFlags())
+	if err == nil && callback != nil {
+		err = callback(r.start)
+		if err != nil {
+			err = common.NewHTTPError(500, "replication error: %s", err)
+		}
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	err = s.complete([]*reservation{r}, err)
+	if err != nil {
+		return -1, err
+	}
+	return r.start, nil
+}
+
+// prepareData compresses data with the storage codec unless
+// compression makes it bigger. Returns the codec ID actually used
+func (s *Storage) prepareData(data []byte) (*bytes.Buffer, uint8, error) {
+	var codec Codec = s.codec
+	if s.dict != nil && len(data) <= s.GetChunkDataSize() {
+		// the dictionary is trained on small items
+		codec = s.dict
+	}
+	if codec.ID() == CodecNone {
+		return bytes.NewBuffer(data), CodecNone, nil
+	}
+
 	plainDataLength := len(data)
 	log.Debugf("data size is %d", plainDataLength)
-	buf, err := zip(data)
-	gzipped := true
+	buf, err := compress(codec, data)
 	if err != nil {
 		log.Errorf("error compressing data: %s", err)
-		return -1, common.NewHTTPError(500, "error compressing data: %s", err)
+		return nil, CodecNone, common.NewHTTPError(500, "error compressing data: %s", err)
 	}
-	log.Debugf("compressed data size is %d", buf.Len())
+	log.Debugf("%s compressed data size is %d", codec.Name(), buf.Len())
 
 	if plainDataLength < buf.Len() {
 		log.Debug("about to write uncompressed data")
-		buf = bytes.NewBuffer(data)
-		gzipped = false
+		return bytes.NewBuffer(data), CodecNone, nil
 	}
-	s.locker.Lock()
-	defer s.locker.Unlock()
-	if idx < 0 {
-		idx = int(s.header.FreeChunkIdx)
+	return buf, codec.ID(), nil
+}
+
+// WriteTo writes data into chunks starting from given idx
+func (s *Storage) WriteTo(data []byte, idx int, callback ReplicationCallback) (int, error) {
+	return s.WriteToMeta(data, idx, nil, callback)
+}
+
+// WriteToMeta writes data with a metadata record into chunks starting
+// from given idx. meta may be nil. If meta.Expires is set the item
+// expires at that time
+func (s *Storage) WriteToMeta(data []byte, idx int, meta *ItemMeta, callback ReplicationCallback) (int, error) {
+	item, err := s.EncodeItem(data, meta)
+	if err != nil {
+		return -1, err
 	}
+	return s.WriteEncodedTo(item, idx, callback)
+}
 
-	idx, err = s.writeTo(buf, idx, callback, gzipped)
+// WriteEncodedTo writes an item encoded with EncodeItem, possibly by
+// another storage, into chunks starting from given idx. If idx is negative
+// the item is placed into free chunks
+func (s *Storage) WriteEncodedTo(item *EncodedItem, idx int, callback ReplicationCallback) (int, error) {
+	err := s.checkEncoded(item)
+	if err != nil {
+		return -1, err
+	}
+
+	if idx < 0 {
+		idx, err = s.appendItem(item, callback)
+	} else {
+		s.writeLock.Lock()
+		s.locker.Lock()
+		idx, err = s.writeTo(item, idx, callback)
+		s.locker.Unlock()
+		s.writeLock.Unlock()
+	}
 	if err != nil {
 		log.Errorf("error writing data to storage: %s", err)
+		return idx, err
 	}
-	return idx, err
+
+	err = s.sync()
+	if err != nil {
+		log.Errorf("error syncing storage: %s", err)
+		return -1, common.NewHTTPError(500, "error syncing storage: %s", err)
+	}
+	return idx, nil
 }
 
 // Write writes data into free chunks of storage
@@ -243,68 +968,117 @@ func (s *Storage) Write(data []byte, callback ReplicationCallback) (int, error)
 	return s.WriteTo(data, -1, callback)
 }
 
-func (s *Storage) readRaw(idx int) (*bytes.Buffer, int, bool, error) {
+// WriteMeta writes data with a metadata record into free chunks
+// of storage and returns index of the starting chunk
+func (s *Storage) WriteMeta(data []byte, meta *ItemMeta, callback ReplicationCallback) (int, error) {
+	return s.WriteToMeta(data, -1, meta, callback)
+}
+
+// readRaw returns stored data of an item (compressed, along with
+// a metadata record if any), the number of chunks and the codec ID
+func (s *Storage) readRaw(idx int) (*bytes.Buffer, int, uint8, error) {
 	var outBuffer bytes.Buffer
-	var header chunkHeader
-	var err error
-	var chunkCount = 0
-	headerBytes := make([]byte, chunkHeaderSize)
 
-	s.locker.RLock()
-	defer s.locker.RUnlock()
+	cr, err := s.newChainReader(idx)
+	if err != nil {
+		return nil, 0, CodecNone, err
+	}
+	_, err = readSize(cr)
+	if err != nil {
+		return nil, 0, CodecNone, err
+	}
+	_, err = outBuffer.ReadFrom(cr)
+	if err != nil {
+		return nil, 0, CodecNone, err
+	}
 
-	for {
-		chunkCount++
-		if idx >= int(s.header.FreeChunkIdx) || idx < 0 {
-			return nil, 0, false, common.NewHTTPError(404, "index %d out of bounds", idx)
-		}
+	return &outBuffer, cr.chunks, cr.head.Codec, nil
+}
 
-		pos := s.getChunkPosition(idx)
+// Read reads and uncompresses the item starting at idx
+func (s *Storage) Read(idx int) ([]byte, error) {
+	log.Debugf("reading item %d", idx)
+	rd, err := s.OpenItem(idx)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
 
-		// reading chunk header
-		_, err = s.backend.ReadAt(headerBytes, int64(pos))
-		if err != nil {
-			return nil, 0, false, common.NewHTTPError(500, "error reading chunk header: %s", err)
+// Delete marks all the chunks of the item starting at idx as deleted
+// and puts them to the free list so they can be reused by subsequent writes
+func (s *Storage) Delete(idx int, callback ReplicationCallback) error {
+	err := s.deleteItem(idx, false, callback)
+	if err != nil {
+		return err
+	}
+
+	err = s.sync()
+	if err != nil {
+		log.Errorf("error syncing storage: %s", err)
+		return common.NewHTTPError(500, "error syncing storage: %s", err)
+	}
+	return nil
+}
+
+// deleteItem deletes the item starting at idx. If expiredOnly is set the
+// item is deleted only if it has expired, 409 is returned otherwise
+func (s *Storage) deleteItem(idx int, expiredOnly bool, callback ReplicationCallback) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	// statistics are read without locker held so appends aren't blocked
+	// by items written before sizeVersion which have to be read through,
+	// the item can't change while writeLock is held
+	deleted, derr := s.liveItemStats(idx)
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	log.Debugf("deleting item %d", idx)
+	chunks := make([]int, 0, 1)
+	curr := idx
+	for curr >= 0 {
+		if curr >= int(s.header.FreeChunkIdx) {
+			return common.NewHTTPError(404, "index %d out of bounds", curr)
 		}
-		headerBuffer := bytes.NewBuffer(headerBytes)
-		err = binary.Read(headerBuffer, binaryLayout, &header)
+		header, err := s.readChunkHeader(curr)
 		if err != nil {
-			return nil, 0, false, common.NewHTTPError(500, "error parsing chunk header: %s", err)
+			return err
 		}
-
-		// reading chunk data
-		dataBytes := make([]byte, header.DataSize)
-		_, err = s.backend.ReadAt(dataBytes, int64(pos+chunkHeaderSize))
-		if err != nil {
-			return nil, 0, false, common.NewHTTPError(500, "error reading chunk data: %s", err)
+		if header.isDeleted() {
+			return errDeleted(idx)
 		}
-		_, err = outBuffer.Write(dataBytes)
-		if err != nil {
-			return nil, 0, false, common.NewHTTPError(500, "error writing to buffer: %s", err)
+		if expiredOnly && curr == idx && !isExpired(header.ExpiresAt, time.Now()) {
+			return common.NewHTTPError(409, "item %d hasn't expired", idx)
 		}
+		chunks = append(chunks, curr)
+		curr = int(header.Next)
+	}
 
-		if header.Next < 0 {
-			break
+	if callback != nil {
+		err := callback(idx)
+		if err != nil {
+			return common.NewHTTPError(500, "replication error: %s", err)
 		}
-		idx = int(header.Next)
 	}
 
-	return &outBuffer, chunkCount, header.Compressed, nil
-}
-
-func (s *Storage) Read(idx int) ([]byte, error) {
-	log.Debugf("reading item %d", idx)
-	buf, _, gzipped, err := s.readRaw(idx)
+	err := s.setChainFlags(chunks, chunkDeleted, true)
 	if err != nil {
-		return nil, err
+		log.Errorf("error deleting item %d: %s", idx, err)
+		return err
+	}
+	s.invalidateCache(idx)
+	for _, chunk := range chunks {
+		s.free.add(chunk, 1)
 	}
 
-	if gzipped {
-		log.Debugf("uncompressing item %d", idx)
-		return unzip(buf)
+	s.removeStats(idx, deleted, derr)
+	err = s.writeHeader()
+	if err != nil {
+		log.Errorf("error writing storage header: %s", err)
+		return common.NewHTTPError(500, "error writing storage header: %s", err)
 	}
-	log.Debugf("item %d is not compressed", idx)
-	return buf.Bytes(), nil
+	return nil
 }
 
 // GetID returns storage ID from storage file header
@@ -319,6 +1093,8 @@ func (s *Storage) GetChunkSize() int {
 
 // GetNumChunks returns total number of chunks from storage file header
 func (s *Storage) GetNumChunks() int {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
 	return int(s.header.NumChunks)
 }
 
@@ -331,37 +1107,17 @@ func (s *Storage) GetChunkDataSize() int {
 func (s *Storage) IsFull() bool {
 	s.locker.RLock()
 	defer s.locker.RUnlock()
-	return s.header.FreeChunkIdx >= s.header.NumChunks
+	return s.header.isFull() && s.free.size() == 0
 }
 
 // Iter iterates over items calling callback with each item
-// it comes across
+// it comes across. Deleted items are skipped
 func (s *Storage) Iter(callback IterationCallback) error {
-	var data []byte
-	s.locker.RLock()
-	defer s.locker.RUnlock()
-
-	idx := 0
-	for idx < int(s.header.FreeChunkIdx) {
-		buf, length, gzipped, err := s.readRaw(idx)
-		if err != nil {
-			return err
-		}
-
-		if gzipped {
-			data, err = unzip(buf)
-			if err != nil {
-				return err
-			}
-		} else {
-			data = buf.Bytes()
-		}
-
-		err = callback(idx, data)
+	return s.IterItems(func(idx int, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
 		if err != nil {
 			return err
 		}
-		idx += length
-	}
-	return nil
+		return callback(idx, data)
+	})
 }
@@ -3,7 +3,18 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/viert/bookstore/common"
 )
 
 var (
@@ -22,7 +33,7 @@ Implementations must not retain p. `)
 func TestBackend(t *testing.T) {
 	mb := NewMemBackend()
 	CreateStorage(mb, 512, 512, 0)
-	expectedLen := storeHeaderSize + 512*(chunkHeaderSize+512)
+	expectedLen := headerAreaSize + 512*(chunkHeaderSize+512)
 	if len(mb.data) != expectedLen {
 		t.Errorf("data len is expected to be %d, got %d instead", expectedLen, len(mb.data))
 	}
@@ -147,6 +158,72 @@ func TestReplication(t *testing.T) {
 	}
 }
 
+func TestEncodedReplication(t *testing.T) {
+	mmb := NewMemBackend()
+	CreateStorage(mmb, 64, 512, 105)
+	master, err := Open(mmb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.SetCodec(zstdCodec{})
+
+	// replicas store items the way master has encoded them
+	// no matter which codec they're set up with
+	rmb := NewMemBackend()
+	CreateStorage(rmb, 64, 512, 105)
+	replica, err := Open(rmb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	meta := &ItemMeta{ContentType: "text/plain", Key: "k", Expires: &expires}
+	item, err := master.EncodeItem(longData, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := master.WriteEncodedTo(item, -1, func(idx int) error {
+		_, err := replica.WriteEncodedTo(item, idx, replicationSucceeded)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _, codec, _ := master.readRaw(idx)
+	raw, _, replCodec, err := replica.readRaw(idx)
+	if err != nil {
+		t.Error(err)
+	}
+	if replCodec != codec || !bytes.Equal(raw.Bytes(), expected.Bytes()) {
+		t.Errorf("replica should store the item compressed with codec %d, got codec %d", codec, replCodec)
+	}
+	replMeta, err := replica.ReadMeta(idx)
+	if err != nil || replMeta == nil || replMeta.Key != "k" || !replMeta.Expires.Equal(expires) {
+		t.Errorf("replica should keep the item metadata, got %+v (%v)", replMeta, err)
+	}
+
+	// a chain mustn't run into a live item
+	next, _ := replica.Write(shortData, replicationSucceeded)
+	big, _ := master.EncodeItem(bytes.Repeat(longData, 10), nil)
+	_, err = replica.WriteEncodedTo(big, next-1, replicationSucceeded)
+	if err == nil {
+		t.Error("writing an item over a live one should cause an error")
+	}
+	read, err := replica.Read(next)
+	if err != nil || !bytes.Equal(read, shortData) {
+		t.Error("the live item must stay intact")
+	}
+
+	// encryption settings must match
+	keys, _ := ParseKeyring([]byte("1 " + strings.Repeat("01", KeySize)))
+	replica.SetKeyring(keys)
+	_, err = replica.WriteEncodedTo(item, -1, replicationSucceeded)
+	if err == nil {
+		t.Error("an item encoded for another key should be refused")
+	}
+}
+
 func TestUncompressed(t *testing.T) {
 	mb := NewMemBackend()
 	CreateStorage(mb, 512, 512, 104)
@@ -161,7 +238,7 @@ func TestUncompressed(t *testing.T) {
 		t.Error(err)
 	}
 
-	buf, count, gzipped, err := st.readRaw(0)
+	buf, count, codec, err := st.readRaw(0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -170,8 +247,8 @@ func TestUncompressed(t *testing.T) {
 		t.Errorf("size of data in chunks must be 1, got %d instead", count)
 	}
 
-	if gzipped {
-		t.Errorf("gzipped should be false for very short data")
+	if codec != CodecNone {
+		t.Errorf("very short data should be stored uncompressed, got codec %d instead", codec)
 	}
 
 	if !bytes.Equal(buf.Bytes(), veryShortData) {
@@ -179,3 +256,2355 @@ func TestUncompressed(t *testing.T) {
 	}
 
 }
+
+func TestDelete(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 512, 512, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	i, _ := st.Write(shortData, replicationSucceeded)
+	j, _ := st.Write(longData, replicationSucceeded)
+	k, _ := st.Write(veryShortData, replicationSucceeded)
+
+	err = st.Delete(j, replicationFailed)
+	if err == nil {
+		t.Error("delete with failed replication should cause an error")
+	}
+	_, err = st.Read(j)
+	if err != nil {
+		t.Errorf("item must be readable after failed deletion, got %s", err)
+	}
+
+	err = st.Delete(j, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = st.Read(j)
+	if herr, ok := err.(common.HTTPError); !ok || herr.Code != 410 {
+		t.Errorf("reading deleted item should cause a 410 error, got %v instead", err)
+	}
+
+	err = st.Delete(j, replicationSucceeded)
+	if err == nil {
+		t.Error("deleting item twice should cause an error")
+	}
+
+	// free list must survive reopening
+	st, err = Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	if st.free.size() != 2 {
+		t.Errorf("free list size is expected to be 2, got %d instead", st.free.size())
+	}
+
+	count := 0
+	st.Iter(func(idx int, data []byte) error {
+		if idx == j {
+			t.Error("deleted item must be skipped by Iter")
+		}
+		count++
+		return nil
+	})
+	if count != 2 {
+		t.Errorf("Iter is expected to find 2 items, got %d instead", count)
+	}
+
+	// deleted chunks are reused before the free chunk idx
+	l, err := st.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	if l != j {
+		t.Errorf("write idx is expected to be %d, got %d instead", j, l)
+	}
+	if st.header.FreeChunkIdx != int32(k+1) {
+		t.Errorf("next free idx is expected to be %d, got %d instead", k+1, st.header.FreeChunkIdx)
+	}
+
+	for _, idx := range []int{i, l} {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(data) != string(shortData) {
+			t.Error("stored and recovered data don't match")
+		}
+	}
+
+	// empty items written into reused chunks mustn't revive deleted data
+	st.Delete(i, replicationSucceeded)
+	m, err := st.Write([]byte{}, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != i {
+		t.Errorf("write idx is expected to be %d, got %d instead", i, m)
+	}
+	st.Delete(m, replicationSucceeded)
+	idxs, err := st.WriteBatch([][]byte{{}, {}}, NopBatchReplicationCallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range idxs {
+		if idx >= k {
+			t.Errorf("empty item %d is expected to reuse deleted chunks", idx)
+		}
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(data) != 0 {
+			t.Errorf("item %d is expected to be empty, got %d bytes", idx, len(data))
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 512, 512, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	i, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// flipping a bit in the second chunk of the item
+	pos := st.getChunkPosition(i+1) + chunkHeaderSize + 10
+	mb.data[pos] ^= 0x04
+
+	_, err = st.Read(i)
+	cerr, ok := err.(ChecksumError)
+	if !ok {
+		t.Errorf("reading corrupted item should cause ChecksumError, got %v instead", err)
+	} else if cerr.Idx != i+1 {
+		t.Errorf("corrupted chunk is expected to be %d, got %d instead", i+1, cerr.Idx)
+	}
+
+	// version 1 storages have no checksums so they aren't verified
+	mb = NewMemBackend()
+	createStorage(mb, 512, 512, 0, 1)
+	st, err = Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	i, err = st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	pos = st.getChunkPosition(i+1) + chunkHeaderSize + 10
+	mb.data[pos] ^= 0x04
+	_, _, _, err = st.readRaw(i)
+	if err != nil {
+		t.Errorf("version 1 storage data must not be verified, got %s", err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	mb := NewMemBackend()
+	createStorage(mb, 512, 512, 0, 1)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	i, _ := st.Write(shortData, replicationSucceeded)
+	j, _ := st.Write(longData, replicationSucceeded)
+
+	// version 1 storages have no checksums and head flags
+	for idx := 0; idx < int(st.header.FreeChunkIdx); idx++ {
+		header, _ := st.readChunkHeader(idx)
+		header.Checksum = 0
+		header.Flags &^= chunkHead
+		st.writeChunkHeader(idx, header)
+	}
+	_, _, err = st.Scan(0, 10, 1<<20, false)
+	if err == nil {
+		t.Error("scanning must fail before upgrade")
+	}
+
+	version, err := ReadVersion(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	steps, err := UpgradeSteps(version)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(steps) != storageVersion-1 {
+		t.Errorf("%d upgrade steps expected, got %d instead", storageVersion-1, len(steps))
+	}
+	if UpgradeRestartable(version) {
+		t.Error("upgrade from version 1 moves chunks in place so it can't be restartable")
+	}
+	if !UpgradeRestartable(headVersion) {
+		t.Errorf("upgrade from version %d is expected to be restartable", headVersion)
+	}
+
+	err = Upgrade(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	st, err = Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	if st.header.Version != storageVersion {
+		t.Errorf("version is expected to be %d after upgrade, got %d instead", storageVersion, st.header.Version)
+	}
+
+	data, err := st.Read(i)
+	if err != nil || string(data) != string(shortData) {
+		t.Errorf("item %d must be readable after upgrade: %v", i, err)
+	}
+	data, err = st.Read(j)
+	if err != nil || string(data) != string(longData) {
+		t.Errorf("item %d must be readable after upgrade: %v", j, err)
+	}
+	items, _, err := st.Scan(-1, 10, 1<<20, true)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(items) != 2 || items[0].Idx != j || items[1].Idx != i {
+		t.Errorf("reverse scan after upgrade is expected to find items %d and %d, got %v", j, i, items)
+	}
+
+	if _, ok := st.Stats(); ok {
+		t.Error("statistics must be invalid after upgrade")
+	}
+	stats, err := st.RebuildStats()
+	if err != nil {
+		t.Error(err)
+	}
+	if stats.Items != 2 || stats.RawBytes != int64(len(shortData)+len(longData)) {
+		t.Errorf("rebuilt statistics are wrong: %+v", stats)
+	}
+	if _, ok := st.Stats(); !ok {
+		t.Error("statistics must be valid once rebuilt")
+	}
+}
+
+func TestHeaderSlots(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 512, 512, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	st.Write(shortData, replicationSucceeded)
+	st.Write(longData, replicationSucceeded)
+	st.Write(veryShortData, replicationSucceeded)
+
+	// tearing the latest header slot makes the previous one be used,
+	// the item written after it is found in chunks
+	slot := int(st.header.Seq % headerSlotCount)
+	mb.data[slot*storeHeaderSize+20] ^= 0xff
+	st, err = Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	if st.header.FreeChunkIdx != 4 {
+		t.Errorf("next free idx is expected to be 4, got %d instead", st.header.FreeChunkIdx)
+	}
+
+	// with both slots damaged the free chunk idx is recovered from chunks
+	st.Write(shortData, replicationSucceeded)
+	for slot := 0; slot < headerSlotCount; slot++ {
+		mb.data[slot*storeHeaderSize+20] ^= 0xff
+	}
+	st, err = Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	if st.header.FreeChunkIdx != 5 {
+		t.Errorf("next free idx is expected to be recovered as 5, got %d instead", st.header.FreeChunkIdx)
+	}
+	data, err := st.Read(4)
+	if err != nil || string(data) != string(shortData) {
+		t.Errorf("item 4 must be readable after recovery: %v", err)
+	}
+
+	// recovered header must be valid again
+	_, valid, err := readStoreHeader(mb)
+	if err != nil || !valid {
+		t.Errorf("header must be valid after recovery: %v", err)
+	}
+
+	// a valid but stale header is advanced past the items written after it
+	st.header.FreeChunkIdx = 1
+	st.writeHeader()
+	st.writeHeader()
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.header.FreeChunkIdx != 5 {
+		t.Errorf("next free idx is expected to be advanced to 5, got %d instead", st.header.FreeChunkIdx)
+	}
+	if _, ok := st.Stats(); ok {
+		t.Error("statistics mustn't be valid once the header is advanced")
+	}
+
+	// storages opened read-only are recovered in memory
+	for _, damaged := range []bool{false, true} {
+		st.header.FreeChunkIdx = 1
+		st.writeHeader()
+		st.writeHeader()
+		if damaged {
+			for slot := 0; slot < headerSlotCount; slot++ {
+				mb.data[slot*storeHeaderSize+20] ^= 0xff
+			}
+		}
+		stored := append([]byte(nil), mb.data...)
+		ro, err := OpenReadOnly(readOnlyBackend{mb})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ro.header.FreeChunkIdx != 5 {
+			t.Errorf("next free idx is expected to be advanced to 5 in memory, got %d instead", ro.header.FreeChunkIdx)
+		}
+		if data, err := ro.Read(4); err != nil || string(data) != string(shortData) {
+			t.Errorf("item 4 must be readable from a read-only storage: %v", err)
+		}
+		if !bytes.Equal(mb.data, stored) {
+			t.Error("read-only storage mustn't be written to")
+		}
+		st, err = Open(mb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// concurrent writers may leave unwritten chunks in between of items
+	st.locker.Lock()
+	gap, _ := st.reserveTail(1)
+	r, _ := st.reserveTail(1)
+	st.locker.Unlock()
+	_, err = st.writeChunks(&EncodedItem{Payload: veryShortData}, r.start, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := 0; slot < headerSlotCount; slot++ {
+		mb.data[slot*storeHeaderSize+20] ^= 0xff
+	}
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.header.FreeChunkIdx != int32(r.start+1) {
+		t.Errorf("next free idx is expected to be recovered as %d, got %d instead", r.start+1, st.header.FreeChunkIdx)
+	}
+	if st.free.find(1) != gap.start {
+		t.Errorf("unwritten chunk %d is expected to become free", gap.start)
+	}
+	count := 0
+	err = st.Iter(func(idx int, data []byte) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 5 {
+		t.Errorf("5 items are expected after recovery, got %d (%v)", count, err)
+	}
+
+	// failed writes to given indices past free chunk idx don't come back
+	free := int(st.header.FreeChunkIdx)
+	_, err = st.WriteTo(longData, free, replicationFailed)
+	if err == nil {
+		t.Error("failed replication should cause an error")
+	}
+	_, err = st.WriteBatchTo([][]byte{shortData, longData}, []int{free, free + 1}, func(idxs []int) error {
+		return fmt.Errorf("replication failed")
+	})
+	if err == nil {
+		t.Error("failed batch replication should cause an error")
+	}
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.header.FreeChunkIdx != int32(free) {
+		t.Errorf("next free idx is expected to stay %d after failed writes, got %d", free, st.header.FreeChunkIdx)
+	}
+	for _, idx := range []int{free, free + 1} {
+		if _, err := st.Read(idx); err == nil {
+			t.Errorf("item %d written with failed replication is readable after reopening", idx)
+		}
+	}
+
+	// headers of older storages are trusted as they are since chunks
+	// of failed writes were left behind
+	mb = NewMemBackend()
+	createStorage(mb, 512, 512, 0, 1)
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write(shortData, replicationSucceeded)
+	_, err = st.writeChunks(&EncodedItem{Payload: veryShortData}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.header.FreeChunkIdx != 1 {
+		t.Errorf("next free idx of a version 1 storage is expected to stay 1, got %d", st.header.FreeChunkIdx)
+	}
+}
+
+// readOnlyBackend fails all the writes like a file opened read-only
+type readOnlyBackend struct {
+	*MemBackend
+}
+
+func (rb readOnlyBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("backend is read-only")
+}
+
+func (rb readOnlyBackend) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("backend is read-only")
+}
+
+type syncingBackend struct {
+	*MemBackend
+	syncs int32
+}
+
+func (sb *syncingBackend) Sync() error {
+	atomic.AddInt32(&sb.syncs, 1)
+	return nil
+}
+
+func TestDurability(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 512, 512, 0)
+	st, _ := Open(mb)
+	st.SetDurability(DurabilityAlways, 0)
+	if st.Durability() != DurabilityNone {
+		t.Errorf("backend without Sync() can't provide durability, got %s", st.Durability())
+	}
+
+	sb := &syncingBackend{MemBackend: NewMemBackend()}
+	CreateStorage(sb, 512, 512, 0)
+	st, err := Open(sb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	st.SetDurability(DurabilityAlways, 0)
+	st.Write(shortData, replicationSucceeded)
+	st.Write(shortData, replicationSucceeded)
+	if sb.syncs != 2 {
+		t.Errorf("2 syncs expected in always mode, got %d instead", sb.syncs)
+	}
+
+	sb.syncs = 0
+	st.SetDurability(DurabilityGroup, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := st.Write(shortData, replicationSucceeded)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	syncs := atomic.LoadInt32(&sb.syncs)
+	if syncs < 1 || syncs > 2 {
+		t.Errorf("10 concurrent writes are expected to share 1 or 2 syncs in group mode, got %d", syncs)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 512, 512, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	batch := [][]byte{shortData, longData, veryShortData}
+
+	_, err = st.WriteBatch(batch, func(idxs []int) error {
+		return fmt.Errorf("replication failed")
+	})
+	if err == nil {
+		t.Error("batch write with failed replication should cause an error")
+	}
+	if st.header.FreeChunkIdx != 0 {
+		t.Errorf("failed batch must not be committed, next free idx is %d", st.header.FreeChunkIdx)
+	}
+
+	replicated := 0
+	idxs, err := st.WriteBatch(batch, func(idxs []int) error {
+		replicated = len(idxs)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if replicated != len(batch) {
+		t.Errorf("all %d items must be replicated at once, got %d", len(batch), replicated)
+	}
+	if st.header.FreeChunkIdx != 4 {
+		t.Errorf("next free idx is expected to be 4, got %d instead", st.header.FreeChunkIdx)
+	}
+
+	for i, idx := range idxs {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, batch[i]) {
+			t.Errorf("stored and recovered data of item %d don't match", idx)
+		}
+	}
+
+	// deleted chunks are reused by batches as well
+	st.Delete(idxs[1], replicationSucceeded)
+	idxs2, err := st.WriteBatch([][]byte{shortData, shortData, shortData}, NopBatchReplicationCallback)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []int{idxs[1], idxs[1] + 1, 4}
+	for i := range expected {
+		if idxs2[i] != expected[i] {
+			t.Errorf("batch indices are expected to be %v, got %v instead", expected, idxs2)
+			break
+		}
+	}
+}
+
+func TestOpenItem(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// random data is incompressible so it takes lots of chunks
+	bigData := make([]byte, 20000)
+	rand.Read(bigData)
+
+	i, _ := st.Write(longData, replicationSucceeded)
+	j, _ := st.Write(bigData, replicationSucceeded)
+	k, _ := st.Write(shortData, replicationSucceeded)
+
+	for idx, expected := range map[int][]byte{i: longData, j: bigData, k: shortData} {
+		rd, err := st.OpenItem(idx)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		data, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("streamed and stored data of item %d don't match", idx)
+		}
+	}
+
+	_, err = st.OpenItem(k + 100)
+	if err == nil {
+		t.Error("opening item out of bounds should cause an error")
+	}
+
+	// callbacks not reading items till the end must not break iteration
+	found := make([]int, 0)
+	err = st.IterItems(func(idx int, r io.Reader) error {
+		found = append(found, idx)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(found) != 3 || found[0] != i || found[1] != j || found[2] != k {
+		t.Errorf("items %v expected, got %v instead", []int{i, j, k}, found)
+	}
+
+	// an item deleted while it's read is skipped
+	found = found[:0]
+	err = st.IterItems(func(idx int, r io.Reader) error {
+		if idx == j {
+			r.Read(make([]byte, 100))
+			st.Delete(j, replicationSucceeded)
+		}
+		_, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		found = append(found, idx)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("deleting an item while iterating shouldn't cause an error, got %s", err)
+	}
+	if len(found) != 2 || found[0] != i || found[1] != k {
+		t.Errorf("items %v expected, got %v instead", []int{i, k}, found)
+	}
+}
+
+func TestItemWriter(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	bigData := make([]byte, 20000)
+	rand.Read(bigData)
+
+	// writing in pieces not aligned to chunk size
+	w, err := st.NewItemWriter(replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(bigData); offset += 777 {
+		end := offset + 777
+		if end > len(bigData) {
+			end = len(bigData)
+		}
+		_, err = w.Write(bigData[offset:end])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data, err := st.Read(w.Index())
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, bigData) {
+		t.Error("written and stored data don't match")
+	}
+
+	w, _ = st.NewItemWriter(replicationSucceeded)
+	w.Write(bigData)
+	w.Abort()
+	_, err = st.Read(w.Index())
+	if err == nil {
+		t.Error("aborted item must not be committed")
+	}
+
+	w, _ = st.NewItemWriter(replicationFailed)
+	w.Write(bigData)
+	err = w.Close()
+	if err == nil {
+		t.Error("failed replication should cause an error")
+	}
+	_, err = st.Read(w.Index())
+	if err == nil {
+		t.Error("item must not be committed if replication fails")
+	}
+
+	// small items are stored as if they were written by Write
+	idx, _ := st.Write(shortData, replicationSucceeded)
+	w, _ = st.NewItemWriter(replicationSucceeded)
+	w.Write(shortData)
+	err = w.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	data, err = st.Read(w.Index())
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, shortData) {
+		t.Error("written and stored data don't match")
+	}
+	expected, _, _, _ := st.readRaw(idx)
+	raw, _, _, _ := st.readRaw(w.Index())
+	if !bytes.Equal(raw.Bytes(), expected.Bytes()) {
+		t.Error("small item should be stored the same way Write does")
+	}
+
+	_, err = w.Write(shortData)
+	if err == nil {
+		t.Error("writing to a closed writer should cause an error")
+	}
+
+	// an abandoned writer blocks neither writes nor deletes nor grow,
+	// its chunks are reclaimed when the storage is reopened
+	abandoned, _ := st.NewItemWriter(replicationSucceeded)
+	abandoned.Write(bigData)
+	abandoned.Write(bigData)
+	done := make(chan error, 1)
+	go func() {
+		idx, err := st.Write(longData, replicationSucceeded)
+		if err == nil {
+			err = st.Delete(idx, replicationSucceeded)
+		}
+		if err == nil {
+			err = st.Grow(st.GetNumChunks()+8, NopGrowCallback)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned item writer blocks other writers")
+	}
+
+	reserved := 0
+	for _, r := range abandoned.res {
+		reserved += r.count
+	}
+	free := st.free.size()
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.free.size() != free+reserved {
+		t.Errorf("%d free chunks expected after reopening, got %d", free+reserved, st.free.size())
+	}
+	_, err = st.Read(abandoned.Index())
+	if err == nil {
+		t.Error("abandoned item must not be committed")
+	}
+}
+
+func TestItemWriterInterleaving(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bigData := make([]byte, 20000)
+	rand.Read(bigData)
+	otherData := make([]byte, 30000)
+	rand.Read(otherData)
+
+	// chains of concurrent writers interleave with each other
+	// and with items written meanwhile
+	w1, _ := st.NewItemWriter(replicationSucceeded)
+	w2, _ := st.NewItemWriter(replicationSucceeded)
+	written := make(map[int][]byte)
+	for offset := 0; offset < len(otherData); offset += 5000 {
+		if offset < len(bigData) {
+			w1.Write(bigData[offset : offset+5000])
+		}
+		w2.Write(otherData[offset : offset+5000])
+		idx, _ := st.Write(shortData, replicationSucceeded)
+		written[idx] = shortData
+	}
+	for _, w := range []*ItemWriter{w1, w2} {
+		err = w.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	written[w1.Index()] = bigData
+	written[w2.Index()] = otherData
+
+	found := make(map[int][]byte)
+	err = st.Iter(func(idx int, data []byte) error {
+		found[idx] = data
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	items, _, err := st.Scan(0, 100, 1<<20, false)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(found) != len(written) || len(items) != len(written) {
+		t.Errorf("%d items expected, iterated over %d, scanned %d", len(written), len(found), len(items))
+	}
+	for idx, data := range written {
+		if !bytes.Equal(found[idx], data) {
+			t.Errorf("written and iterated data of item %d don't match", idx)
+		}
+	}
+
+	stats, _ := st.Stats()
+	rebuilt, err := st.RebuildStats()
+	if err != nil {
+		t.Error(err)
+	}
+	if rebuilt != stats {
+		t.Errorf("rebuilt statistics %+v don't match %+v", rebuilt, stats)
+	}
+
+	freeChunkIdx := st.header.FreeChunkIdx
+	err = st.recoverHeader()
+	if err != nil {
+		t.Error(err)
+	}
+	if st.header.FreeChunkIdx != freeChunkIdx {
+		t.Errorf("recovered free chunk index should be %d, got %d", freeChunkIdx, st.header.FreeChunkIdx)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	bigData := make([]byte, 20000)
+	rand.Read(bigData)
+
+	// every codec writes items readable along with items of other codecs
+	written := make(map[int][]byte)
+	for _, name := range CodecNames() {
+		codec, err := CodecByName(name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		st.SetCodec(codec)
+
+		idx, err := st.Write(longData, replicationSucceeded)
+		if err != nil {
+			t.Error(err)
+		}
+		written[idx] = longData
+
+		_, _, id, err := st.readRaw(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if id != codec.ID() {
+			t.Errorf("item should be compressed with %s, got codec %d instead", name, id)
+		}
+
+		w, err := st.NewItemWriter(replicationSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bigData)
+		err = w.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		written[w.Index()] = bigData
+	}
+
+	for idx, expected := range written {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("written and stored data of item %d don't match", idx)
+		}
+	}
+
+	// zstd encoders and decoders are shared, items read partially
+	// leave nothing behind for the next readers
+	st.SetCodec(zstdCodec{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				data := []byte(fmt.Sprintf("%d-%d %s", i, j, longData))
+				idx, err := st.Write(data, replicationSucceeded)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r, err := st.OpenItem(idx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.ReadFull(r, make([]byte, 10))
+				r.Close()
+				stored, err := st.Read(idx)
+				if err != nil || !bytes.Equal(stored, data) {
+					t.Errorf("item %d compressed with a shared encoder is read wrong: %v", idx, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = CodecByName("lzma")
+	if err == nil {
+		t.Error("unknown codec name should cause an error")
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 512, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	doc := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i, i))
+	}
+	for i := 0; i < 1000; i++ {
+		_, err = st.Write(doc(i), replicationSucceeded)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	dict, err := st.TrainDictionary(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := st.TrainDictionary(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.AssignDictionary(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.AssignDictionary(dict)
+	if err == nil {
+		t.Error("assigning a dictionary twice should cause an error")
+	}
+
+	idx, err := st.Write(doc(1000), replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	buf, _, codec, err := st.readRaw(idx)
+	if err != nil {
+		t.Error(err)
+	}
+	if codec != CodecZstdDict {
+		t.Errorf("small item should be compressed with dictionary, got codec %d instead", codec)
+	}
+	if buf.Len() >= len(doc(1000)) {
+		t.Errorf("dictionary should make small item smaller, got %d bytes of %d", buf.Len(), len(doc(1000)))
+	}
+
+	st, err = Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	if st.DictionaryID() == 0 {
+		t.Error("dictionary id should be stored in the header")
+	}
+	_, err = st.Read(idx)
+	if err == nil {
+		t.Error("reading item without its dictionary should cause an error")
+	}
+
+	err = st.SetDictionary(other)
+	if err == nil {
+		t.Error("loading a foreign dictionary should cause an error")
+	}
+
+	err = st.SetDictionary(dict)
+	if err != nil {
+		t.Error(err)
+	}
+	data, err := st.Read(idx)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, doc(1000)) {
+		t.Error("written and stored data don't match")
+	}
+}
+
+func TestMmapBackend(t *testing.T) {
+	f, err := ioutil.TempFile("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	CreateStorage(f, 256, 64, 0)
+	mb, err := NewMmapBackend(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mb.Close()
+
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	data, err := st.Read(i)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, longData) {
+		t.Error("written and stored data don't match")
+	}
+
+	// reading past the mapped area remaps the file
+	end, _ := f.Seek(0, io.SeekEnd)
+	_, err = mb.WriteAt(veryShortData, end)
+	if err != nil {
+		t.Error(err)
+	}
+	p := make([]byte, len(veryShortData))
+	_, err = mb.ReadAt(p, end)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(p, veryShortData) {
+		t.Error("data written past the mapped area doesn't match")
+	}
+
+	// slices taken before remapping stay valid
+	data, err = st.Read(i)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, longData) {
+		t.Error("written and stored data don't match after remapping")
+	}
+
+	_, err = mb.ReadAt(p, end+int64(len(p)))
+	if err == nil {
+		t.Error("reading past the end of file should cause an error")
+	}
+
+	// an item deleted and overwritten while it's read is served as it
+	// was when it has been read, not mixed with the new one
+	st.SetCodec(noneCodec{})
+	j, err := st.Write(veryShortData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := st.newChainReader(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cr.mapped || &cr.buf[0] != &mb.data[st.header.chunkOffset(j)+int64(chunkHeaderSize)] {
+		t.Error("data is expected to be served right from the mapping")
+	}
+	rd, err := st.OpenItem(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 5)
+	io.ReadFull(rd, head)
+	st.Delete(j, replicationSucceeded)
+	k, err := st.Write([]byte("HELLO WORLD"), replicationSucceeded)
+	if err != nil || k != j {
+		t.Fatalf("item is expected to be written to chunk %d, got %d (%v)", j, k, err)
+	}
+	rest, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if !isDeleted(err) {
+		t.Errorf("item is expected to be reported deleted, got %q (%v)", string(head)+string(rest), err)
+	}
+}
+
+func TestGrow(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	i, err := st.Write(veryShortData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = st.Write(longData, replicationSucceeded)
+	if err == nil {
+		t.Error("writing data not fitting into storage should cause an error")
+	}
+
+	err = st.Grow(600, func(numChunks int) error {
+		return fmt.Errorf("replica is unavailable")
+	})
+	if err == nil {
+		t.Error("failed replication should cause an error")
+	}
+	if st.GetNumChunks() != 4 {
+		t.Error("storage must not grow if replication fails")
+	}
+
+	err = st.Grow(600, NopGrowCallback)
+	if err != nil {
+		t.Error(err)
+	}
+	err = st.Grow(100, NopGrowCallback)
+	if err == nil {
+		t.Error("shrinking storage should cause an error")
+	}
+
+	j, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.GetNumChunks() != 600 {
+		t.Errorf("storage is expected to have 600 chunks, got %d instead", st.GetNumChunks())
+	}
+	for idx, expected := range map[int][]byte{i: veryShortData, j: longData} {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("written and stored data of item %d don't match", idx)
+		}
+	}
+}
+
+func TestSegmented(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := dir + "/storage"
+
+	_, err = CreateSegmentedStorage(base, 64, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := OpenSegmentedBackend(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := Open(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// random data is incompressible so it takes lots of chunks
+	bigData := make([]byte, 5000)
+	rand.Read(bigData)
+
+	written := make(map[int][]byte)
+	for i := 0; i < 5; i++ {
+		idx, err := st.Write(longData, replicationSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written[idx] = longData
+		idx, err = st.Write(bigData, replicationSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written[idx] = bigData
+	}
+
+	if st.IsFull() {
+		t.Error("segmented storage must never be full")
+	}
+	numChunks := st.GetNumChunks()
+	if numChunks%16 != 0 || numChunks < int(st.header.FreeChunkIdx) {
+		t.Errorf("storage is expected to consist of whole segments, got %d chunks", numChunks)
+	}
+	_, err = os.Stat(SegmentFileName(base, numChunks/16-1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = st.Grow(numChunks+1, NopGrowCallback)
+	if err != nil {
+		t.Error(err)
+	}
+	if st.GetNumChunks() != numChunks+16 {
+		t.Errorf("storage is expected to grow by a whole segment, got %d chunks", st.GetNumChunks())
+	}
+	sb.Close()
+
+	sb, err = OpenSegmentedBackend(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	st, err = Open(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, expected := range written {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("written and stored data of item %d don't match", idx)
+		}
+	}
+
+	// a segment must not be mistaken for a whole storage
+	f, err := os.Open(SegmentFileName(base, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	segmented, err := IsSegmented(f)
+	if err != nil || !segmented {
+		t.Errorf("the first segment is expected to be recognized, got %v, %v", segmented, err)
+	}
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 16, 0)
+	segmented, err = IsSegmented(mb)
+	if err != nil || segmented {
+		t.Errorf("storage file is recognized as a segment, got %v, %v", segmented, err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	key1 := "1 " + strings.Repeat("01", KeySize)
+	key2 := "2 " + strings.Repeat("02", KeySize)
+
+	_, err := ParseKeyring([]byte("1 0102"))
+	if err == nil {
+		t.Error("short key should cause an error")
+	}
+	keys, err := ParseKeyring([]byte("# old key\n" + key1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+	st.SetKeyring(keys)
+	st.SetCodec(noneCodec{})
+
+	bigData := make([]byte, 5000)
+	rand.Read(bigData)
+
+	i, _ := st.Write(veryShortData, replicationSucceeded)
+	j, _ := st.Write(longData, replicationSucceeded)
+	w, err := st.NewItemWriter(replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(bigData)
+	err = w.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	k := w.Index()
+	written := map[int][]byte{i: veryShortData, j: longData, k: bigData}
+
+	if bytes.Contains(mb.data, veryShortData) {
+		t.Error("item data must not be stored as plain text")
+	}
+
+	check := func(st *Storage) {
+		for idx, expected := range written {
+			data, err := st.Read(idx)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(data, expected) {
+				t.Errorf("written and stored data of item %d don't match", idx)
+			}
+		}
+	}
+	check(st)
+
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Read(i)
+	if err == nil {
+		t.Error("reading encrypted item without keys should cause an error")
+	}
+
+	keys, _ = ParseKeyring([]byte(key1 + "\n" + key2))
+	st.SetKeyring(keys)
+	count, err := st.Rekey()
+	if err != nil {
+		t.Error(err)
+	}
+	if count == 0 {
+		t.Error("chunks should be re-encrypted with the new key")
+	}
+
+	// the old key is not needed anymore
+	keys, _ = ParseKeyring([]byte(key2))
+	st.SetKeyring(keys)
+	check(st)
+}
+
+func TestMeta(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	meta := &ItemMeta{
+		ContentType: "text/plain",
+		Attrs:       map[string]string{"owner": "test"},
+	}
+	i, err := st.WriteMeta(longData, meta, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	j, err := st.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+
+	m, err := st.ReadMeta(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ContentType != "text/plain" || m.Attrs["owner"] != "test" {
+		t.Errorf("stored metadata doesn't match: %+v", m)
+	}
+	if m.Length != len(longData) || m.Codec != "gzip" || m.Created.IsZero() {
+		t.Errorf("metadata should be completed by storage: %+v", m)
+	}
+
+	data, err := st.Read(i)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, longData) {
+		t.Error("written and stored data don't match")
+	}
+
+	m, err = st.ReadMeta(j)
+	if err != nil {
+		t.Error(err)
+	}
+	if m != nil {
+		t.Error("item written without metadata should have no metadata")
+	}
+
+	meta.Attrs["junk"] = strings.Repeat("x", MaxMetaSize)
+	_, err = st.WriteMeta(shortData, meta, replicationSucceeded)
+	if err == nil {
+		t.Error("too large metadata should cause an error")
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/keys.idx"
+
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"first", "second", "key with\nnewline"} {
+		_, err = st.WriteMeta(shortData, &ItemMeta{Key: key}, replicationSucceeded)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err = st.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the index file doesn't exist so it's rebuilt
+	ki, err := OpenKeyIndex(filename, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.Len() != 3 {
+		t.Errorf("index should have 3 keys, got %d", ki.Len())
+	}
+	prevIdx, _ := ki.Get("second")
+
+	idx, err := st.WriteMeta(longData, &ItemMeta{Key: "second"}, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	prev, found, err := ki.Set("second", idx)
+	if err != nil {
+		t.Error(err)
+	}
+	if !found || prev != prevIdx {
+		t.Errorf("previous index of the key should be %d, got %d", prevIdx, prev)
+	}
+	ki.Close()
+
+	ki, err = OpenKeyIndex(filename, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+	for _, key := range []string{"first", "second", "key with\nnewline"} {
+		i, found := ki.Get(key)
+		if !found {
+			t.Errorf("key %q not found", key)
+			continue
+		}
+		meta, err := st.ReadMeta(i)
+		if err != nil {
+			t.Error(err)
+		} else if meta.Key != key {
+			t.Errorf("key %q points to the item stored under %q", key, meta.Key)
+		}
+	}
+	if i, _ := ki.Get("second"); i != idx {
+		t.Errorf("key should point to the last item %d, got %d", idx, i)
+	}
+	if _, found := ki.Get("third"); found {
+		t.Error("unknown key shouldn't be found")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/sha256.idx"
+
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.WriteMeta(shortData, &ItemMeta{}, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the index is rebuilt from the storage
+	hi, err := OpenHashIndex(filename, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hi.Close()
+
+	found, ok := hi.Find(longData)
+	if !ok || found != idx {
+		t.Errorf("stored item %d should be found, got %d %v", idx, found, ok)
+	}
+	if _, ok = hi.Find(shortData); ok {
+		t.Error("items with metadata shouldn't be deduplicated")
+	}
+
+	sidx, err := st.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hi.Add(shortData, sidx)
+	if err != nil {
+		t.Error(err)
+	}
+	if found, ok = hi.Find(shortData); !ok || found != sidx {
+		t.Errorf("added item %d should be found, got %d %v", sidx, found, ok)
+	}
+
+	err = st.Delete(idx, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, ok = hi.Find(longData); ok {
+		t.Error("deleted items shouldn't be found")
+	}
+
+	if hi.Hits() != 2 || hi.SavedBytes() != int64(len(longData)+len(shortData)) {
+		t.Errorf("invalid dedup stats: %d hits, %d bytes saved", hi.Hits(), hi.SavedBytes())
+	}
+}
+
+func TestCache(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetCacheSize(len(longData) * cacheItemFraction)
+
+	idx, err := st.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lidx, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, shortData) {
+			t.Error("written and read data don't match")
+		}
+	}
+	hits, misses := st.CacheStats()
+	if hits != 2 || misses != 1 {
+		t.Errorf("2 hits and 1 miss expected, got %d and %d", hits, misses)
+	}
+
+	// overwriting an item on replica must invalidate it
+	newData := bytes.ToUpper(shortData)
+	_, err = st.WriteTo(newData, idx, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := st.Read(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, newData) {
+		t.Error("overwritten item is served from cache")
+	}
+
+	err = st.Delete(lidx, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Read(lidx)
+	if err == nil {
+		t.Error("deleted item is served from cache")
+	}
+
+	// a reader opened before invalidation mustn't put stale data
+	rd, err := st.OpenItem(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Delete(idx, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rd)
+	rd.Close()
+	_, err = st.Read(idx)
+	if err == nil {
+		t.Error("deleted item is served from cache")
+	}
+}
+
+func TestLockFreeReads(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a writer stuck in replication mustn't block readers
+	replicating := make(chan struct{})
+	release := make(chan struct{})
+	written := make(chan error)
+	go func() {
+		_, err := st.Write(shortData, func(idx int) error {
+			close(replicating)
+			<-release
+			return nil
+		})
+		written <- err
+	}()
+	<-replicating
+
+	read := make(chan error)
+	go func() {
+		data, err := st.Read(idx)
+		if err == nil && !bytes.Equal(data, longData) {
+			err = fmt.Errorf("written and read data don't match")
+		}
+		if err == nil {
+			err = st.Iter(func(idx int, data []byte) error { return nil })
+		}
+		read <- err
+	}()
+
+	select {
+	case err = <-read:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("reads are blocked by a writer")
+	}
+	close(release)
+	if err = <-written; err != nil {
+		t.Error(err)
+	}
+
+	// readers running along with writers see complete items only
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := st.Iter(func(idx int, data []byte) error {
+					if !bytes.Equal(data, longData) && !bytes.Equal(data, shortData) {
+						return fmt.Errorf("item %d is read incomplete", idx)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		_, err = st.Write(longData, replicationSucceeded)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// chunks of a deleted item reused by another one while the item
+	// is read aren't spliced into it
+	first := make([]byte, 500)
+	second := make([]byte, 500)
+	rand.Read(first)
+	rand.Read(second)
+	idx, err = st.Write(first, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := st.OpenItem(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(r, make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Delete(idx, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused, err := st.Write(second, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != idx {
+		t.Fatalf("chunks of item %d are expected to be reused, got item %d", idx, reused)
+	}
+	_, err = ioutil.ReadAll(r)
+	if !isDeleted(err) {
+		t.Errorf("reading an item replaced meanwhile is expected to fail with 410, got %v", err)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all the writers must get into replication at once
+	const writers = 4
+	var inReplication sync.WaitGroup
+	inReplication.Add(writers)
+	allIn := make(chan struct{})
+	go func() {
+		inReplication.Wait()
+		close(allIn)
+	}()
+
+	type result struct {
+		idx int
+		err error
+	}
+	results := make(chan result, writers)
+	failedIdx := -1
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			idx, err := st.Write(longData, func(idx int) error {
+				inReplication.Done()
+				select {
+				case <-allIn:
+				case <-time.After(5 * time.Second):
+					return fmt.Errorf("replication is serialized")
+				}
+				// the second writer fails so its chunks get tombstoned
+				if i == 1 {
+					failedIdx = idx
+					return fmt.Errorf("replication failed")
+				}
+				return nil
+			})
+			results <- result{idx, err}
+		}(i)
+	}
+
+	failed := 0
+	idxs := make([]int, 0, writers)
+	for i := 0; i < writers; i++ {
+		res := <-results
+		if res.err != nil {
+			failed++
+			continue
+		}
+		idxs = append(idxs, res.idx)
+	}
+	if failed != 1 {
+		t.Fatalf("one writer should fail, %d failed", failed)
+	}
+
+	for _, idx := range idxs {
+		data, err := st.Read(idx)
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, longData) {
+			t.Errorf("item %d doesn't match written data", idx)
+		}
+	}
+
+	count := 0
+	err = st.Iter(func(idx int, data []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if count != writers-1 {
+		t.Errorf("%d items expected, got %d", writers-1, count)
+	}
+
+	// chunks of the failed item are either tombstoned or rolled back,
+	// anyway they're reused
+	idx, err := st.Write(longData, replicationSucceeded)
+	if err != nil {
+		t.Error(err)
+	}
+	if idx != failedIdx {
+		t.Errorf("chunks of the failed item %d should be reused, got index %d", failedIdx, idx)
+	}
+}
+
+func TestOutOfOrderReplication(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second item arrives first leaving a gap for the first one
+	_, err = st.WriteTo(shortData, 20, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = st.Iter(func(idx int, data []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 1 {
+		t.Errorf("gap chunks shouldn't be iterated over, got %d items", count)
+	}
+
+	_, err = st.WriteTo(shortData, 0, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := st.Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, shortData) {
+		t.Error("item written into the gap doesn't match")
+	}
+
+	// the rest of the gap is reused by appends
+	idx, err := st.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx >= 20 {
+		t.Errorf("append should reuse gap chunks, got index %d", idx)
+	}
+}
+
+func TestScan(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idxs []int
+	for i := 0; i < 10; i++ {
+		data := shortData
+		if i%3 == 0 {
+			data = longData
+		}
+		idx, err := st.Write(data, replicationSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 1 {
+			st.Delete(idx, replicationSucceeded)
+			continue
+		}
+		idxs = append(idxs, idx)
+	}
+
+	// chunks of deleted items are reused so indexes aren't ordered
+	sort.Ints(idxs)
+
+	scanAll := func(from int, reverse bool) []int {
+		var found []int
+		for pages := 0; from != -1 || pages == 0; pages++ {
+			if pages > len(idxs) {
+				t.Fatal("scan doesn't stop")
+			}
+			var items []ScanItem
+			items, from, err = st.Scan(from, 3, 1<<20, reverse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) > 3 {
+				t.Errorf("scan returned %d items, limit is 3", len(items))
+			}
+			for _, item := range items {
+				expected := shortData
+				if len(item.Data) == len(longData) {
+					expected = longData
+				}
+				if !bytes.Equal(item.Data, expected) {
+					t.Errorf("item %d data doesn't match", item.Idx)
+				}
+				found = append(found, item.Idx)
+			}
+		}
+		return found
+	}
+
+	found := scanAll(0, false)
+	if fmt.Sprint(found) != fmt.Sprint(idxs) {
+		t.Errorf("forward scan is expected to find %v, got %v", idxs, found)
+	}
+
+	found = scanAll(-1, true)
+	for i := len(found) - 1; i >= len(found)/2; i-- {
+		found[i], found[len(found)-1-i] = found[len(found)-1-i], found[i]
+	}
+	if fmt.Sprint(found) != fmt.Sprint(idxs) {
+		t.Errorf("reverse scan is expected to find %v reversed, got %v", idxs, found)
+	}
+
+	// a cursor in the middle of an item starts from the next one
+	// going forward and from the item itself going backwards
+	items, _, err := st.Scan(idxs[0]+1, 1, 1<<20, false)
+	if err != nil || len(items) != 1 || items[0].Idx != idxs[1] {
+		t.Errorf("forward scan from %d is expected to start at %d, got %v (%v)", idxs[0]+1, idxs[1], items, err)
+	}
+	items, _, err = st.Scan(idxs[0]+1, 1, 1<<20, true)
+	if err != nil || len(items) != 1 || items[0].Idx != idxs[0] {
+		t.Errorf("reverse scan from %d is expected to start at %d, got %v (%v)", idxs[0]+1, idxs[0], items, err)
+	}
+
+	// data of items over the size limit is left out, sizes of items
+	// written by older versions are found out by reading them
+	for _, version := range []int32{statsVersion, storageVersion} {
+		mb = NewMemBackend()
+		createStorage(mb, 64, 4096, 0, version)
+		st, _ = Open(mb)
+		st.Write(shortData, replicationSucceeded)
+		st.Write(longData, replicationSucceeded)
+		items, _, err = st.Scan(0, 10, len(shortData), false)
+		if err != nil || len(items) != 2 {
+			t.Fatalf("scan is expected to find 2 items, got %v (%v)", items, err)
+		}
+		if items[0].Large || !bytes.Equal(items[0].Data, shortData) {
+			t.Errorf("version %d: item within the size limit is expected to be included", version)
+		}
+		if !items[1].Large || items[1].Data != nil {
+			t.Errorf("version %d: data of item over the size limit is expected to be left out", version)
+		}
+	}
+}
+
+func TestParallelIter(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("item %d", i))
+		if i%5 == 0 {
+			data = append(data, longData...)
+		}
+		idx, err := st.Write(data, replicationSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 3 {
+			st.Delete(idx, replicationSucceeded)
+		}
+	}
+
+	var expected []string
+	st.Iter(func(idx int, data []byte) error {
+		expected = append(expected, fmt.Sprintf("%d:%s", idx, data))
+		return nil
+	})
+
+	var found []string
+	err = st.ParallelIter(4, true, func(idx int, data []byte) error {
+		found = append(found, fmt.Sprintf("%d:%s", idx, data))
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Error("ordered parallel iteration doesn't match Iter")
+	}
+
+	var lock sync.Mutex
+	found = nil
+	err = st.ParallelIter(4, false, func(idx int, data []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		found = append(found, fmt.Sprintf("%d:%s", idx, data))
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	sort.Strings(found)
+	sort.Strings(expected)
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Error("unordered parallel iteration doesn't find the same items as Iter")
+	}
+
+	// items larger than a chunk are streamed by the callback
+	found = nil
+	err = st.ParallelIterItems(4, true, func(idx int, meta *ItemMeta, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		found = append(found, fmt.Sprintf("%d:%s", idx, data))
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	sort.Strings(found)
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Error("parallel iteration over item readers doesn't find the same items as Iter")
+	}
+
+	for _, ordered := range []bool{true, false} {
+		stopErr := fmt.Errorf("stop")
+		err = st.ParallelIter(4, ordered, func(idx int, data []byte) error {
+			return stopErr
+		})
+		if err != stopErr {
+			t.Errorf("callback error is expected to stop iteration, got %v", err)
+		}
+	}
+}
+
+func TestCopyItemsMeta(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	src, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb = NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	dst, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	items := map[string][]byte{"short": shortData, "long": longData}
+	for key, data := range items {
+		meta := &ItemMeta{
+			Key:         key,
+			ContentType: "text/plain",
+			Expires:     &expires,
+			Attrs:       map[string]string{"owner": "test"},
+		}
+		_, err = src.WriteMeta(data, meta, replicationSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = src.Write(shortData, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// items are copied the way bsctl move does
+	copied := map[int]int{}
+	err = src.ParallelIterItems(2, true, func(idx int, meta *ItemMeta, r io.Reader) error {
+		w, err := dst.NewItemWriterMeta(meta, replicationSucceeded)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		copied[idx] = w.Index()
+		return w.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != 3 {
+		t.Fatalf("expected 3 items to be copied, got %d", len(copied))
+	}
+
+	for from, to := range copied {
+		data, err := dst.Read(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig, _ := src.Read(from)
+		if !bytes.Equal(data, orig) {
+			t.Errorf("copy of item %d doesn't match the original", from)
+		}
+
+		origMeta, _ := src.ReadMeta(from)
+		meta, err := dst.ReadMeta(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origMeta == nil {
+			if meta != nil {
+				t.Errorf("copy of item %d written without metadata has metadata", from)
+			}
+			continue
+		}
+		if meta == nil {
+			t.Fatalf("metadata of item %d is lost", from)
+		}
+		if meta.Key != origMeta.Key || meta.ContentType != "text/plain" || meta.Attrs["owner"] != "test" ||
+			meta.Length != len(data) || !meta.Created.Equal(origMeta.Created) {
+			t.Errorf("copied metadata doesn't match: %+v, expected %+v", meta, origMeta)
+		}
+		if meta.Expires == nil || !meta.Expires.Equal(expires) {
+			t.Errorf("expiration time of item %d is lost: %v", from, meta.Expires)
+		}
+		header, err := dst.readChunkHeader(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.ExpiresAt != uint32(expires.Unix()) {
+			t.Errorf("copy of item %d expires at %d, expected %d", from, header.ExpiresAt, expires.Unix())
+		}
+	}
+
+	keys := make(map[string]int)
+	err = rebuildKeys(dst, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(items) {
+		t.Errorf("expected %d keys in copies, got %d", len(items), len(keys))
+	}
+	for key := range items {
+		if _, found := keys[key]; !found {
+			t.Errorf("key %s is lost in copies", key)
+		}
+	}
+
+	// the metadata record precedes streamed data so the length is checked
+	w, err := dst.NewItemWriterMeta(&ItemMeta{Length: 1}, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(longData)
+	if w.Close() == nil {
+		t.Error("data not matching the metadata length should cause an error")
+	}
+}
+
+func TestStats(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, ok := st.Stats()
+	if !ok || stats != (Stats{}) {
+		t.Errorf("a new storage must have zero valid statistics, got %+v", stats)
+	}
+
+	i, _ := st.Write(shortData, replicationSucceeded)
+	st.Write(longData, replicationSucceeded)
+	st.WriteMeta(veryShortData, &ItemMeta{ContentType: "text/plain"}, replicationSucceeded)
+	st.WriteBatch([][]byte{shortData, veryShortData}, NopBatchReplicationCallback)
+	w, _ := st.NewItemWriter(replicationSucceeded)
+	w.Write(longData)
+	w.Write(longData)
+	w.Close()
+	st.Delete(i, replicationSucceeded)
+	// reuses chunks of the deleted item
+	st.Write(veryShortData, replicationSucceeded)
+	// overwrites the item
+	st.WriteTo(bytes.ToUpper(veryShortData), i, replicationSucceeded)
+
+	stats, ok = st.Stats()
+	if !ok {
+		t.Fatal("statistics must be valid")
+	}
+	if stats.Items != 6 {
+		t.Errorf("6 items expected, got %d", stats.Items)
+	}
+	expectedRaw := int64(len(longData)*3 + len(shortData) + len(veryShortData)*3)
+	if stats.RawBytes != expectedRaw {
+		t.Errorf("raw bytes are expected to be %d, got %d", expectedRaw, stats.RawBytes)
+	}
+
+	rebuilt, err := st.RebuildStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt != stats {
+		t.Errorf("rebuilt statistics %+v don't match counted ones %+v", rebuilt, stats)
+	}
+
+	st, err = Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, ok := st.Stats()
+	if !ok || reopened != stats {
+		t.Errorf("statistics must persist, got %+v instead of %+v", reopened, stats)
+	}
+
+	// items keep their sizes so they aren't read through for statistics
+	st.Iter(func(idx int, data []byte) error {
+		header, _ := st.readChunkHeader(idx)
+		if header.Flags&chunkSized == 0 {
+			t.Errorf("item %d is expected to keep its size", idx)
+		}
+		return nil
+	})
+
+	// statistics rebuilt while items are written and deleted
+	// must match the ones counted afterwards
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for n := 0; n < 4; n++ {
+		owned := make([]int, 0)
+		for k := 0; k < 200; k++ {
+			idx, _ := st.Write(longData[:100*(n+1)], replicationSucceeded)
+			owned = append(owned, idx)
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for k := 0; ; k++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// deleted chunks are reused so items change
+				// on both sides of the rebuild cursor
+				victim := rand.Intn(len(owned))
+				st.Delete(owned[victim], replicationSucceeded)
+				idx, err := st.Write(longData[:100*(n+1)+k%100], replicationSucceeded)
+				if err == nil {
+					owned[victim] = idx
+				}
+			}
+		}(n)
+	}
+	for n := 0; n < 10; n++ {
+		_, err = st.RebuildStats()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	stats, ok = st.Stats()
+	if !ok {
+		t.Fatal("statistics must be valid")
+	}
+	rebuilt, err = st.RebuildStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt != stats {
+		t.Errorf("statistics rebuilt during writes %+v don't match actual ones %+v", stats, rebuilt)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	mb := NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, err := Open(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	expired, err := st.WriteMeta(longData, &ItemMeta{Expires: &past}, replicationSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, _ := st.WriteMeta(shortData, &ItemMeta{Expires: &future}, replicationSucceeded)
+	st.Write(veryShortData, replicationSucceeded)
+
+	_, err = st.Read(expired)
+	if herr, ok := err.(common.HTTPError); !ok || herr.Code != 404 {
+		t.Errorf("expired item must not be found, got %v", err)
+	}
+	_, err = st.Read(live)
+	if err != nil {
+		t.Errorf("item which hasn't expired must be readable: %v", err)
+	}
+
+	count := 0
+	st.Iter(func(idx int, data []byte) error {
+		if idx == expired {
+			t.Error("expired item must be skipped by Iter")
+		}
+		count++
+		return nil
+	})
+	if count != 2 {
+		t.Errorf("Iter is expected to find 2 items, got %d", count)
+	}
+
+	var reaped []int
+	n, err := st.ReapExpired(func(idx int) error {
+		reaped = append(reaped, idx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(reaped) != 1 || reaped[0] != expired {
+		t.Errorf("only item %d is expected to be reaped, got %v", expired, reaped)
+	}
+	_, err = st.Read(expired)
+	if herr, ok := err.(common.HTTPError); !ok || herr.Code != 410 {
+		t.Errorf("reaped item must be deleted, got %v", err)
+	}
+	if stats, _ := st.Stats(); stats.Items != 2 {
+		t.Errorf("2 items are expected to be left, got %d", stats.Items)
+	}
+
+	// the chunks are reused
+	idx, _ := st.Write(longData, replicationSucceeded)
+	if idx != expired {
+		t.Errorf("chunks of the reaped item are expected to be reused, got index %d", idx)
+	}
+	n, _ = st.ReapExpired(replicationSucceeded)
+	if n != 0 {
+		t.Errorf("nothing is expected to be reaped, got %d items", n)
+	}
+
+	// the storage isn't scanned again until the live item expires
+	if next := atomic.LoadUint32(&st.nextExpiry); next != uint32(future.Unix()) {
+		t.Errorf("next expiry is expected to be %d, got %d", future.Unix(), next)
+	}
+	expired, _ = st.WriteMeta(shortData, &ItemMeta{Expires: &past}, replicationSucceeded)
+	n, _ = st.ReapExpired(replicationSucceeded)
+	if n != 1 {
+		t.Errorf("item %d written after the scan is expected to be reaped, got %d items", expired, n)
+	}
+
+	// notes taken before a scan are kept even if the scan missed their items
+	st.noteExpiry(uint32(past.Unix()))
+	atomic.StoreUint32(&st.nextExpiry, unknownExpiry)
+	st.ReapExpired(replicationSucceeded)
+	if next := atomic.LoadUint32(&st.nextExpiry); next != uint32(past.Unix()) {
+		t.Errorf("next expiry is expected to be %d, got %d", past.Unix(), next)
+	}
+
+	// storages without expiring items are scanned once
+	mb = NewMemBackend()
+	CreateStorage(mb, 64, 4096, 0)
+	st, _ = Open(mb)
+	st.Write(shortData, replicationSucceeded)
+	st.ReapExpired(replicationSucceeded)
+	if next := atomic.LoadUint32(&st.nextExpiry); next != noExpiry {
+		t.Errorf("storage without expiring items isn't expected to be scanned again, next expiry is %d", next)
+	}
+}
@@ -5,7 +5,33 @@ import (
 	"io"
 )
 
+// storeHeader is the storage header. Since version 3 it is written into one
+// of two alternating slots of the header area, every slot is protected with
+// a checksum so a torn header write can't damage the other one.
+// DictID is the id of the compression dictionary, zero if there's none.
+// SegmentChunks is the number of chunks per segment file of a segmented
+// storage, zero for single file storages. Since version 5 the header
+// keeps statistics of live items which are trusted if StatsValid is set
 type storeHeader struct {
+	StorageID     uint64
+	Version       int32
+	ChunkSize     int32
+	NumChunks     int32
+	FreeChunkIdx  int32
+	Seq           uint64
+	DictID        uint32
+	SegmentChunks int32
+	Items         int64
+	UsedChunks    int64
+	StoredBytes   int64
+	RawBytes      int64
+	StatsValid    uint8
+	Reserved      [179]byte
+	Checksum      uint32
+}
+
+// legacyHeader is the storage header of versions 1 and 2
+type legacyHeader struct {
 	StorageID    uint64
 	Version      int32
 	ChunkSize    int32
@@ -13,26 +39,113 @@ type storeHeader struct {
 	FreeChunkIdx int32
 }
 
+// chunkHeader is the header of every chunk. Codec is the ID of the codec
+// the item data is compressed with (it used to be a "compressed" bool
+// so files written before are read as gzip or none). KeyID is the id of
+// the key chunk data is encrypted with, zero means no encryption.
+// ExpiresAt is the unix time the item expires at, it's set in the first
+// chunk only, zero means the item never expires. Gen is the generation of
+// the item, the same in all its chunks, so readers following Next without
+// locks notice chunks reused by another item. It's zero in chunks written
+// before it was introduced
 type chunkHeader struct {
-	DataSize   int32
-	Next       int32
-	Compressed bool
-	Reserved   [23]byte
+	DataSize  int32
+	Next      int32
+	Codec     uint8
+	Flags     uint8
+	Checksum  uint32
+	KeyID     uint8
+	Nonce     [12]byte
+	ExpiresAt uint32
+	Gen       uint8
 }
 
-// Backend represents an interface of storage backend (typically a file)
+const (
+	// chunkDeleted marks every chunk of a deleted item (tombstone)
+	chunkDeleted uint8 = 1 << iota
+	// chunkMeta marks the first chunk of an item starting with
+	// a metadata record
+	chunkMeta
+	// chunkHead marks the first chunk of every item so item starts
+	// can be found without walking chains from the beginning
+	chunkHead
+	// chunkSized marks the first chunk of an item starting with its
+	// uncompressed size, followed by a metadata record if any
+	chunkSized
+)
+
+const (
+	headerSlotCount = 2
+)
+
+// Backend represents an interface of storage backend (typically a file).
+// Backends must support reads concurrent with writes to other offsets
+// since readers take no storage locks
 type Backend interface {
 	io.ReaderAt
 	io.WriterAt
 	io.Writer
 }
 
+// Slicer is an optional interface of a backend able to return its
+// contents without copying (e.g. a memory mapped file). Returned
+// slices must stay valid for the backend lifetime, their contents
+// change as the backend is written to
+type Slicer interface {
+	Slice(off int64, n int) ([]byte, error)
+}
+
 var (
-	storeHeaderSize = binary.Size(storeHeader{})
-	chunkHeaderSize = binary.Size(chunkHeader{})
-	binaryLayout    = binary.LittleEndian
+	storeHeaderSize  = binary.Size(storeHeader{})
+	legacyHeaderSize = binary.Size(legacyHeader{})
+	headerAreaSize   = headerSlotCount * storeHeaderSize
+	chunkHeaderSize  = binary.Size(chunkHeader{})
+	binaryLayout     = binary.LittleEndian
 )
 
 func (h *storeHeader) isFull() bool {
+	if h.segmented() && h.NumChunks <= MaxSegmentedNumChunks-h.SegmentChunks {
+		// there's always room for another segment
+		return false
+	}
 	return h.FreeChunkIdx >= h.NumChunks
 }
+
+func (h *storeHeader) segmented() bool {
+	return h.SegmentChunks > 0
+}
+
+// segmentSize returns the size of a segment file. Every segment starts
+// with a header area so chunk offsets are computed the same way for all
+// of them, though the header is stored in the first segment only
+func (h *storeHeader) segmentSize() int64 {
+	return int64(h.dataOffset()) + int64(h.SegmentChunks)*int64(h.ChunkSize)
+}
+
+// chunkOffset returns the position of chunk idx regardless of NumChunks.
+// For segmented storages the position is in the space of concatenated
+// segment files
+func (h *storeHeader) chunkOffset(idx int) int64 {
+	if !h.segmented() {
+		return int64(h.dataOffset()) + int64(idx)*int64(h.ChunkSize)
+	}
+	segment := idx / int(h.SegmentChunks)
+	idx = idx % int(h.SegmentChunks)
+	return int64(segment)*h.segmentSize() + int64(h.dataOffset()) + int64(idx)*int64(h.ChunkSize)
+}
+
+// dataOffset returns the position of the first chunk
+func (h *storeHeader) dataOffset() int {
+	if h.Version < slotVersion {
+		return legacyHeaderSize
+	}
+	return headerAreaSize
+}
+
+func (ch *chunkHeader) isDeleted() bool {
+	return ch.Flags&chunkDeleted != 0
+}
+
+func (ch *chunkHeader) isHead() bool {
+	return ch.Flags&chunkHead != 0
+}
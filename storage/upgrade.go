@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// upgradeStep migrates a storage from one version to the next one in place.
+// Steps must keep item indices. Steps which can't be safely run again after
+// an interruption are marked as not restartable
+type upgradeStep struct {
+	description string
+	restartable bool
+	run         func(s *Storage) error
+}
+
+// upgradeSteps is a registry of migrations keyed by the version they upgrade from
+var upgradeSteps = map[int32]upgradeStep{
+	1: {"compute CRC32C checksums of chunks", true, upgradeV1ToV2},
+	2: {"move chunks to make room for double-buffered header slots", false, upgradeV2ToV3},
+	3: {"mark first chunks of items", true, upgradeV3ToV4},
+	4: {"reset item statistics, rebuild them with the server once upgraded", true, upgradeV4ToV5},
+	5: {"keep sizes of new items in their first chunks", true, upgradeV5ToV6},
+}
+
+// ReadVersion returns format version of a storage without opening it
+func ReadVersion(backend Backend) (int, error) {
+	header, _, err := readStoreHeader(backend)
+	if err != nil {
+		return 0, err
+	}
+	return int(header.Version), nil
+}
+
+// UpgradeSteps returns descriptions of migrations needed to bring
+// a storage of the given version up to the current format version
+func UpgradeSteps(version int) ([]string, error) {
+	if version > storageVersion {
+		return nil, fmt.Errorf("storage version %d is newer than software version %d", version, storageVersion)
+	}
+	steps := make([]string, 0)
+	for v := int32(version); v < storageVersion; v++ {
+		step, found := upgradeSteps[v]
+		if !found {
+			return nil, fmt.Errorf("no upgrade available from version %d", v)
+		}
+		description := fmt.Sprintf("v%d -> v%d: %s", v, v+1, step.description)
+		if !step.restartable {
+			description += " (not restartable, make a backup)"
+		}
+		steps = append(steps, description)
+	}
+	return steps, nil
+}
+
+// UpgradeRestartable tells if all the migrations needed by a storage of
+// the given version can be run again after an interruption. Storages
+// which can't must be backed up before upgrading
+func UpgradeRestartable(version int) bool {
+	for v := int32(version); v < storageVersion; v++ {
+		if step, found := upgradeSteps[v]; found && !step.restartable {
+			return false
+		}
+	}
+	return true
+}
+
+// Upgrade migrates a storage to the current format version in place.
+// Version in the storage header is bumped after every successful step
+func Upgrade(backend Backend) error {
+	header, _, err := readStoreHeader(backend)
+	if err != nil {
+		return fmt.Errorf("error reading storage header: %s", err)
+	}
+
+	_, err = UpgradeSteps(int(header.Version))
+	if err != nil {
+		return err
+	}
+
+	s := &Storage{backend: backend, header: *header}
+	for s.header.Version < storageVersion {
+		step := upgradeSteps[s.header.Version]
+		log.Infof("upgrading storage from version %d to %d: %s",
+			s.header.Version, s.header.Version+1, step.description)
+		err = step.run(s)
+		if err != nil {
+			return fmt.Errorf("error upgrading from version %d: %s", s.header.Version, err)
+		}
+		s.header.Version++
+		err = s.writeHeader()
+		if err != nil {
+			return fmt.Errorf("error writing storage header: %s", err)
+		}
+	}
+	return nil
+}
+
+func upgradeV1ToV2(s *Storage) error {
+	for idx := 0; idx < int(s.header.FreeChunkIdx); idx++ {
+		header, err := s.readChunkHeader(idx)
+		if err != nil {
+			return err
+		}
+		if header.DataSize < 0 || int(header.DataSize) > s.GetChunkDataSize() {
+			return fmt.Errorf("chunk %d has invalid data size %d", idx, header.DataSize)
+		}
+		data := make([]byte, header.DataSize)
+		_, err = s.backend.ReadAt(data, int64(s.getChunkPosition(idx)+chunkHeaderSize))
+		if err != nil {
+			return fmt.Errorf("error reading chunk %d data: %s", idx, err)
+		}
+		header.Checksum = crc32.Checksum(data, crcTable)
+		err = s.writeChunkHeader(idx, header)
+		if err != nil {
+			return fmt.Errorf("error writing chunk %d header: %s", idx, err)
+		}
+	}
+	return nil
+}
+
+// upgradeV2ToV3 moves all the chunks towards the end of file so the legacy
+// header gets replaced with the header area. Chunks are moved starting from
+// the last one as the regions overlap
+func upgradeV2ToV3(s *Storage) error {
+	shift := headerAreaSize - legacyHeaderSize
+	buf := make([]byte, s.header.ChunkSize)
+	for idx := int(s.header.NumChunks) - 1; idx >= 0; idx-- {
+		pos := int64(s.getChunkPosition(idx))
+		_, err := s.backend.ReadAt(buf, pos)
+		if err != nil {
+			return fmt.Errorf("error reading chunk %d: %s", idx, err)
+		}
+		_, err = s.backend.WriteAt(buf, pos+int64(shift))
+		if err != nil {
+			return fmt.Errorf("error writing chunk %d: %s", idx, err)
+		}
+	}
+
+	// both slots are cleared so the stale data can't be taken for a header
+	_, err := s.backend.WriteAt(make([]byte, headerAreaSize), 0)
+	return err
+}
+
+// upgradeV3ToV4 sets chunkHead on first chunks of live items walking them
+// the way IterItems does. Deleted items are left as is, they're never read
+func upgradeV3ToV4(s *Storage) error {
+	idx := 0
+	for idx < int(s.header.FreeChunkIdx) {
+		header, err := s.readChunkHeader(idx)
+		if err != nil {
+			return err
+		}
+		if header.isDeleted() {
+			idx++
+			continue
+		}
+
+		if !header.isHead() {
+			header.Flags |= chunkHead
+			err = s.writeChunkHeader(idx, header)
+			if err != nil {
+				return fmt.Errorf("error writing chunk %d header: %s", idx, err)
+			}
+		}
+
+		idx++
+		for next := int(header.Next); next >= 0; next = int(header.Next) {
+			header, err = s.readChunkHeader(next)
+			if err != nil {
+				return err
+			}
+			idx++
+		}
+	}
+	return nil
+}
+
+// upgradeV4ToV5 clears the statistics area. Items may be encrypted or
+// compressed with a dictionary which aren't available here, so the
+// statistics are rebuilt by a server (see RebuildStats)
+func upgradeV4ToV5(s *Storage) error {
+	s.header.Items = 0
+	s.header.UsedChunks = 0
+	s.header.StoredBytes = 0
+	s.header.RawBytes = 0
+	s.header.StatsValid = 0
+	return nil
+}
+
+// upgradeV5ToV6 changes nothing but the version. Items written before
+// don't keep their sizes (chunkSized isn't set) and are read through
+// when statistics need their sizes
+func upgradeV5ToV6(s *Storage) error {
+	return nil
+}
@@ -11,39 +11,71 @@ import (
 // CreateStorage creates and initializes binary structure
 // of a storage using any io.Writer
 func CreateStorage(w io.Writer, chunkDataSize int, numChunks int, storageID uint64) (uint64, error) {
+	return createStorage(w, chunkDataSize, numChunks, storageID, storageVersion)
+}
+
+func randomStorageID() uint64 {
+	rand.Seed(time.Now().UnixNano())
+	return rand.Uint64()
+}
+
+// createStorage creates a storage of any supported format version
+func createStorage(w io.Writer, chunkDataSize int, numChunks int, storageID uint64, version int32) (uint64, error) {
 	if storageID == 0 {
-		rand.Seed(time.Now().UnixNano())
-		storageID = rand.Uint64()
+		storageID = randomStorageID()
 	}
 
 	header := storeHeader{
 		StorageID:    storageID,
-		Version:      storageVersion,
+		Version:      version,
 		ChunkSize:    int32(chunkDataSize + chunkHeaderSize),
 		NumChunks:    int32(numChunks),
 		FreeChunkIdx: 0,
 	}
 
-	err := binary.Write(w, binaryLayout, header)
+	err := writeStorage(w, &header)
 	if err != nil {
-		return 0, fmt.Errorf("error writing header: %s", err)
+		return 0, err
+	}
+	return storageID, nil
+}
+
+// writeStorage writes a header and empty chunks of a new storage
+func writeStorage(w io.Writer, header *storeHeader) error {
+	var err error
+	if header.Version >= statsVersion {
+		// statistics of an empty storage are all zeroes
+		header.StatsValid = 1
+	}
+	if header.Version < slotVersion {
+		_, err = w.Write(encodeLegacyHeader(header))
+	} else {
+		// the first slot gets the header, the second one is left
+		// invalid until the first header update
+		_, err = w.Write(encodeHeader(header))
+		if err == nil {
+			_, err = w.Write(make([]byte, storeHeaderSize))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error writing header: %s", err)
 	}
 
 	cHeader := new(chunkHeader)
 	cHeader.Next = -1
-	cData := make([]byte, chunkDataSize)
+	cData := make([]byte, header.ChunkSize-int32(chunkHeaderSize))
 
-	for i := 0; i < numChunks; i++ {
+	for i := 0; i < int(header.NumChunks); i++ {
 		err := binary.Write(w, binaryLayout, cHeader)
 		if err != nil {
-			return 0, fmt.Errorf("error writing chunk header: %s", err)
+			return fmt.Errorf("error writing chunk header: %s", err)
 		}
 
 		_, err = w.Write(cData)
 		if err != nil {
-			return 0, fmt.Errorf("error writing chunk data space: %s", err)
+			return fmt.Errorf("error writing chunk data space: %s", err)
 		}
 	}
 
-	return storageID, nil
+	return nil
 }
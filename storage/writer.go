@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/viert/bookstore/common"
+)
+
+// writerBatchChunks is the maximum number of chunks an ItemWriter
+// reserves at once
+const writerBatchChunks = 16
+
+// ItemWriter writes an item into storage as data arrives so the whole
+// item never has to be kept in memory. Data is compressed on the fly
+// with the storage codec. Chunks are reserved in growing batches as they're
+// needed, the storage locks are held only for that moment so a writer never
+// blocks other writes, deletes or grow. The chunks stay tombstones until
+// the writer is closed so the item becomes visible only then; an aborted
+// or failed writer leaves nothing behind.
+//
+// A writer which is neither closed nor aborted keeps its chunks reserved
+// until the storage is reopened, they're reused as tombstones then
+type ItemWriter struct {
+	s        *Storage
+	callback ReplicationCallback
+	idx      int
+	curr     int
+	// batches reserved so far, used is the number of chunks
+	// used in the last one
+	res    []*reservation
+	used   int
+	chunks int
+	raw    []byte
+	buf    []byte
+	codec  Codec
+	zw     io.WriteCloser
+	err    error
+	done   bool
+	// metadata of the item and its expiration time
+	meta      *ItemMeta
+	expiresAt uint32
+	// codec, flags and generation of the item as it's stored
+	codecID   uint8
+	headFlags uint8
+	gen       uint8
+	// sizes of uncompressed data and data flushed to chunks
+	rawSize    int64
+	storedSize int64
+	// the first chunk is written on close when the item size is known
+	head     []byte
+	headNext int
+}
+
+// chunkFiller puts compressed data into chunks of an ItemWriter
+type chunkFiller struct {
+	w *ItemWriter
+}
+
+// NewItemWriter creates a writer of a new item reserving its first chunk.
+// callback is called on Close right before the item is committed
+func (s *Storage) NewItemWriter(callback ReplicationCallback) (*ItemWriter, error) {
+	return s.NewItemWriterMeta(nil, callback)
+}
+
+// NewItemWriterMeta creates a writer of a new item stored with metadata
+// like WriteToMeta does. The metadata record precedes data so meta.Length
+// must be the length of data to be written unless it fits into a chunk,
+// it's checked on Close
+func (s *Storage) NewItemWriterMeta(meta *ItemMeta, callback ReplicationCallback) (*ItemWriter, error) {
+	if s.header.Version < headVersion {
+		// chunks of older storages have to be contiguous
+		return nil, common.NewHTTPError(400, "storage version %d doesn't support item writers, upgrade it first", s.header.Version)
+	}
+
+	w := &ItemWriter{
+		s:        s,
+		callback: callback,
+		raw:      make([]byte, 0, s.chunkPayloadSize()),
+		codec:    s.codec,
+		meta:     meta,
+		gen:      s.nextGen(),
+	}
+	if meta != nil {
+		var err error
+		w.expiresAt, err = meta.expiresAt()
+		if err != nil {
+			return nil, err
+		}
+	}
+	idx, err := w.nextChunk()
+	if err != nil {
+		return nil, err
+	}
+	w.idx = idx
+	w.curr = idx
+	return w, nil
+}
+
+// Index returns index of the item being written
+func (w *ItemWriter) Index() int {
+	return w.idx
+}
+
+func (w *ItemWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("item writer is closed")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.rawSize += int64(len(p))
+
+	if w.zw == nil {
+		// items fitting in one chunk are kept in memory so they're
+		// stored exactly like WriteTo does, uncompressed if it's better
+		if len(w.raw)+len(p) <= cap(w.raw) {
+			w.raw = append(w.raw, p...)
+			return len(p), nil
+		}
+
+		w.buf = make([]byte, 0, w.s.chunkPayloadSize())
+		w.codecID = w.codec.ID()
+		if w.s.header.Version >= sizeVersion {
+			// room for the size which is filled in on close
+			w.buf = w.buf[:sizePrefixSize]
+			w.headFlags = chunkSized
+		}
+		if w.meta != nil {
+			var record []byte
+			record, w.err = w.s.metaRecord(w.meta, w.meta.Length, w.codecID)
+			if w.err != nil {
+				return 0, w.err
+			}
+			_, w.err = chunkFiller{w}.Write(record)
+			if w.err != nil {
+				return 0, w.err
+			}
+			w.headFlags |= chunkMeta
+		}
+		w.zw, w.err = w.codec.NewWriter(chunkFiller{w})
+		if w.err != nil {
+			return 0, w.err
+		}
+		_, w.err = w.zw.Write(w.raw)
+		w.raw = nil
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+
+	n, err := w.zw.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (cf chunkFiller) Write(p []byte) (int, error) {
+	w := cf.w
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			// more data is coming so the full chunk gets linked to the next one
+			next, err := w.nextChunk()
+			if err != nil {
+				return written, err
+			}
+			err = w.flushChunk(next)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// nextChunk returns the next reserved chunk. When the reserved chunks are
+// used up another batch as large as the item so far is reserved
+func (w *ItemWriter) nextChunk() (int, error) {
+	if len(w.res) == 0 || w.used == w.res[len(w.res)-1].count {
+		count := w.chunks
+		if count < 1 {
+			count = 1
+		} else if count > writerBatchChunks {
+			count = writerBatchChunks
+		}
+
+		w.s.writeLock.Lock()
+		w.s.locker.Lock()
+		r, err := w.s.reserveHeld(count)
+		if err != nil && count > 1 {
+			// there may be room for a chunk still
+			r, err = w.s.reserveHeld(1)
+		}
+		w.s.locker.Unlock()
+		w.s.writeLock.Unlock()
+		if err != nil {
+			return -1, err
+		}
+		w.res = append(w.res, r)
+		w.used = 0
+	}
+
+	r := w.res[len(w.res)-1]
+	w.used++
+	w.chunks++
+	return r.start + w.used - 1, nil
+}
+
+func (w *ItemWriter) flushChunk(next int) error {
+	if w.curr == w.idx {
+		w.head = append([]byte(nil), w.buf...)
+		w.headNext = next
+	} else {
+		header := chunkHeader{
+			DataSize: int32(len(w.buf)),
+			Next:     int32(next),
+			Codec:    w.codecID,
+			Flags:    chunkDeleted,
+			Gen:      w.gen,
+		}
+		// the chunk stays a tombstone until the item is committed
+		// so no lock is needed
+		err := w.s.writeChunk(w.curr, &header, w.buf)
+		if err != nil {
+			return err
+		}
+	}
+	w.curr = next
+	w.storedSize += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// writeHead writes the first chunk of the item
+func (w *ItemWriter) writeHead() error {
+	header := chunkHeader{
+		DataSize:  int32(len(w.head)),
+		Next:      int32(w.headNext),
+		Codec:     w.codecID,
+		Flags:     chunkDeleted | chunkHead | w.headFlags,
+		ExpiresAt: w.expiresAt,
+		Gen:       w.gen,
+	}
+	if w.headFlags&chunkSized != 0 {
+		binaryLayout.PutUint64(w.head, uint64(w.rawSize))
+	}
+	w.s.noteExpiry(w.expiresAt)
+	return w.s.writeChunk(w.idx, &header, w.head)
+}
+
+// finish completes the reservations of the writer. Unused chunks
+// go back to the free list. If err is not nil the item is dropped
+func (w *ItemWriter) finish(err error) error {
+	w.s.locker.Lock()
+	last := w.res[len(w.res)-1]
+	if w.used < last.count {
+		w.s.free.add(last.start+w.used, last.count-w.used)
+		last.count = w.used
+	}
+	// the batch of the first chunk is revived last
+	rs := make([]*reservation, len(w.res))
+	for i, r := range w.res {
+		rs[len(rs)-1-i] = r
+	}
+	err = w.s.complete(rs, err)
+	w.s.locker.Unlock()
+	w.done = true
+	return err
+}
+
+// Abort drops the item. Chunks written so far are never committed
+func (w *ItemWriter) Abort() {
+	if !w.done {
+		w.finish(fmt.Errorf("item writer is aborted"))
+	}
+}
+
+// Close flushes the rest of data, calls the replication callback
+// and commits the item if replication succeeds
+func (w *ItemWriter) Close() error {
+	if w.done {
+		return fmt.Errorf("item writer is closed")
+	}
+	err := w.finish(w.close())
+	if err != nil {
+		log.Errorf("error writing item %d: %s", w.idx, err)
+		return err
+	}
+
+	err = w.s.sync()
+	if err != nil {
+		log.Errorf("error syncing storage: %s", err)
+		return common.NewHTTPError(500, "error syncing storage: %s", err)
+	}
+	return nil
+}
+
+func (w *ItemWriter) close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.zw == nil {
+		item, err := w.s.EncodeItem(w.raw, w.meta)
+		if err != nil {
+			return err
+		}
+		w.codecID = item.Codec
+		w.headFlags = item.Flags
+		w.buf = make([]byte, 0, w.s.chunkPayloadSize())
+		_, err = chunkFiller{w}.Write(item.Payload)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := w.zw.Close()
+		if err != nil {
+			return err
+		}
+		if w.meta != nil && w.rawSize != int64(w.meta.Length) {
+			return common.NewHTTPError(400, "item length %d doesn't match metadata length %d", w.rawSize, w.meta.Length)
+		}
+	}
+
+	err := w.flushChunk(-1)
+	if err != nil {
+		return err
+	}
+	err = w.writeHead()
+	if err != nil {
+		return err
+	}
+
+	if w.callback != nil {
+		err := w.callback(w.idx)
+		if err != nil {
+			return common.NewHTTPError(500, "replication error: %s", err)
+		}
+	}
+	w.res[0].stats = itemStats{1, int64(w.chunks), w.storedSize, w.rawSize}
+	return nil
+}